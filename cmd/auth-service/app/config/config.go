@@ -9,6 +9,7 @@ import (
 
 	"github.com/ghodss/yaml"
 
+	"github.com/fezho/oidc-auth/server"
 	"github.com/fezho/oidc-auth/storage"
 	// Register config builders
 	_ "github.com/fezho/oidc-auth/storage/bolt"
@@ -16,10 +17,56 @@ import (
 )
 
 type Config struct {
-	Web     Web     `json:"web"`
-	OIDC    OIDC    `json:"oidc"`
-	Storage Storage `json:"storage"`
-	Logger  Logger  `json:"logger"`
+	Web     Web       `json:"web"`
+	OIDC    Providers `json:"oidc"`
+	Storage Storage   `json:"storage"`
+	Logger  Logger    `json:"logger"`
+	// Rules are access rules of requests, the first matched rule wins,
+	// requests which match no rule require authentication.
+	Rules []server.Rule `json:"rules"`
+	// Bearer configures validation of bearer tokens presented by API clients.
+	Bearer server.BearerConfig `json:"bearer"`
+	// Headers maps response header names to Go templates over the verified claims,
+	// helpers join, lower and default are available, e.g. X-Roles: '{{ join "," .roles }}'.
+	Headers map[string]string `json:"headers"`
+	// Redirect restricts the URLs users are redirected to after login and logout,
+	// rejected redirects fall back to its default URL.
+	Redirect server.RedirectConfig `json:"redirect"`
+	// API configures which requests are answered with 401 and a login URL instead of
+	// a redirect, requests accepting JSON or sent by XMLHttpRequest always are.
+	API server.APIConfig `json:"api"`
+	// SessionInfo configures the response of <root-path>/userinfo, which describes
+	// the session of current user to front-end apps.
+	SessionInfo server.SessionInfoConfig `json:"sessionInfo"`
+	// Assertion configures the signed JWT asserting user identity to upstreams,
+	// whose public keys are served at /.well-known/jwks.json.
+	Assertion server.AssertionConfig `json:"assertion"`
+	// Cookie customizes the session cookie.
+	Cookie server.CookieConfig `json:"cookie"`
+	// SessionLimit limits the concurrent sessions of a user, e.g. maxSessions 1 keeps
+	// a single active session per user. It applies to virtual hosts as well.
+	SessionLimit server.SessionLimitConfig `json:"sessionLimit"`
+	// VirtualHosts are tenants selected by the host of requests,
+	// the above oidc, rules, bearer and cookie are the default for other hosts.
+	VirtualHosts []VirtualHost `json:"virtualHosts"`
+}
+
+// VirtualHost is the config of a tenant, it's used for requests to any of the hosts.
+type VirtualHost struct {
+	// Hosts is a list of host patterns, a leading "*." matches any subdomain.
+	// Required.
+	Hosts   []string            `json:"hosts"`
+	OIDC    Providers           `json:"oidc"`
+	Rules   []server.Rule       `json:"rules"`
+	Bearer  server.BearerConfig `json:"bearer"`
+	Headers map[string]string   `json:"headers"`
+	Cookie  server.CookieConfig `json:"cookie"`
+
+	Assertion server.AssertionConfig `json:"assertion"`
+	Redirect  server.RedirectConfig  `json:"redirect"`
+	API       server.APIConfig       `json:"api"`
+
+	SessionInfo server.SessionInfoConfig `json:"sessionInfo"`
 }
 
 func LoadConfigFromFile(file string) (*Config, error) {
@@ -47,43 +94,207 @@ func (c Config) Validate() error {
 		bad    bool
 		errMsg string
 	}{
-		{c.OIDC.Issuer == "", "no openID connect issuer specified"},
-		{c.OIDC.RedirectURL == "" || c.OIDC.RedirectURL[len(c.OIDC.RedirectURL)-1] == '/',
-			"no openID connect redirect url specified, or trailing slash is not allowed"},
-		{c.OIDC.ClientID == "", "no openID connect client id specified"},
-		{c.OIDC.ClientSecret == "", "no openID connect client secret specified"},
-		{c.OIDC.UsernameClaim == "", "no openID connect user name claim specified"},
 		{c.Storage.Config == nil, "no storage supplied in config file"},
-		{c.Web.HTTP == "" && c.Web.HTTPS == "", "must supply a HTTP/HTTPS  address to listen on"},
+		{c.Web.HTTP == "" && c.Web.HTTPS == "" && c.Web.GRPC == "", "must supply a HTTP/HTTPS  address to listen on"},
 		{c.Web.HTTPS != "" && c.Web.TLSCert == "", "no cert specified for HTTPS"},
 		{c.Web.HTTPS != "" && c.Web.TLSKey == "", "no private key specified for HTTPS"},
+		{c.Web.Admin.HTTP != "" && c.Web.Admin.Token == "", "no token specified for admin API"},
 	}
 
-	var checkErrors []string
+	defaultHost := VirtualHost{
+		OIDC:      c.OIDC,
+		Rules:     c.Rules,
+		Bearer:    c.Bearer,
+		Headers:   c.Headers,
+		Assertion: c.Assertion,
+		Redirect:  c.Redirect,
+		API:       c.API,
+		Cookie:    c.Cookie,
+	}
+	checkErrors := defaultHost.validate()
+	if err := c.Web.TrustedProxy.Validate(); err != nil {
+		checkErrors = append(checkErrors, err.Error())
+	}
+	if err := c.SessionLimit.Validate(); err != nil {
+		checkErrors = append(checkErrors, err.Error())
+	}
 	for _, check := range checks {
 		if check.bad {
 			checkErrors = append(checkErrors, check.errMsg)
 		}
 	}
+	for i, vhost := range c.VirtualHosts {
+		if len(vhost.Hosts) == 0 {
+			checkErrors = append(checkErrors, fmt.Sprintf("no hosts specified for virtual host %d", i))
+			continue
+		}
+		for _, errMsg := range vhost.validate() {
+			checkErrors = append(checkErrors, fmt.Sprintf("virtual host %q: %s", vhost.Hosts[0], errMsg))
+		}
+	}
 	if len(checkErrors) != 0 {
 		return fmt.Errorf("invalid Config:\n\t-\t%s", strings.Join(checkErrors, "\n\t-\t"))
 	}
 	return nil
 }
 
+// validate checks the configuration of a virtual host, the default
+// configuration is checked as a virtual host without hosts.
+func (v VirtualHost) validate() []string {
+	var checkErrors []string
+	if len(v.OIDC) == 0 {
+		checkErrors = append(checkErrors, "no openID connect provider specified")
+	}
+	names := make(map[string]bool)
+	for _, p := range v.OIDC {
+		// errors of a provider are prefixed by its name if there are more than one providers
+		var prefix string
+		if len(v.OIDC) > 1 {
+			prefix = fmt.Sprintf("provider %q: ", p.Name)
+			if p.Name == "" {
+				checkErrors = append(checkErrors, "no openID connect provider name specified for multiple providers")
+			} else if names[p.Name] {
+				checkErrors = append(checkErrors, fmt.Sprintf("duplicate openID connect provider name %q", p.Name))
+			}
+			names[p.Name] = true
+		}
+		for _, errMsg := range p.validate(v.Rules) {
+			checkErrors = append(checkErrors, prefix+errMsg)
+		}
+	}
+	if err := server.ValidateRules(v.Rules); err != nil {
+		checkErrors = append(checkErrors, err.Error())
+	}
+	if err := v.Bearer.Validate(); err != nil {
+		checkErrors = append(checkErrors, err.Error())
+	}
+	if err := server.ValidateHeaders(v.Headers); err != nil {
+		checkErrors = append(checkErrors, err.Error())
+	}
+	if err := v.Assertion.Validate(); err != nil {
+		checkErrors = append(checkErrors, err.Error())
+	}
+	if err := v.Redirect.Validate(); err != nil {
+		checkErrors = append(checkErrors, err.Error())
+	}
+	if err := v.API.Validate(); err != nil {
+		checkErrors = append(checkErrors, err.Error())
+	}
+	return checkErrors
+}
+
+func (o OIDC) validate(rules []server.Rule) []string {
+	checks := []struct {
+		bad    bool
+		errMsg string
+	}{
+		{o.Issuer == "", "no openID connect issuer specified"},
+		{o.RedirectURL == "" || o.RedirectURL[len(o.RedirectURL)-1] == '/',
+			"no openID connect redirect url specified, or trailing slash is not allowed"},
+		{o.ClientID == "", "no openID connect client id specified"},
+		{o.ClientSecret == "" && !o.PublicClient, "no openID connect client secret specified"},
+		{o.PublicClient && o.DisablePKCE, "PKCE can't be disabled for openID connect public client"},
+		{o.UsernameClaim == "", "no openID connect user name claim specified"},
+		{requireGroups(rules) && o.GroupsClaim == "", "no openID connect groups claim specified for group policies of rules"},
+		{requireAccessToken(rules) && !o.StoreAccessToken, "openID connect access token must be stored for rules forwarding it"},
+	}
+
+	var errMsgs []string
+	for _, check := range checks {
+		if check.bad {
+			errMsgs = append(errMsgs, check.errMsg)
+		}
+	}
+	if err := o.UserInfoPrecedence.Validate(); err != nil {
+		errMsgs = append(errMsgs, err.Error())
+	}
+	return errMsgs
+}
+
+// requireGroups reports whether any of the rules has group policies.
+func requireGroups(rules []server.Rule) bool {
+	for _, r := range rules {
+		if len(r.AnyGroups) > 0 || len(r.AllGroups) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAccessToken reports whether any of the rules forwards access token.
+func requireAccessToken(rules []server.Rule) bool {
+	for _, r := range rules {
+		if r.ForwardToken == server.ForwardAccessToken {
+			return true
+		}
+	}
+	return false
+}
+
 // Web is the config format for the HTTP server.
 type Web struct {
 	HTTP    string `json:"http"`
 	HTTPS   string `json:"https"`
 	TLSCert string `json:"tlsCert"`
 	TLSKey  string `json:"tlsKey"`
-	// List of allowed origins for CORS requests on discovery, token and keys endpoint.
-	// If none are indicated, CORS requests are disabled. Passing in "*" will allow any domain.
+	// TrustedProxy configures the proxy sending auth requests, e.g. Traefik ForwardAuth,
+	// the original request is rebuilt from its headers if it's sent from the CIDRs.
+	TrustedProxy server.TrustedProxyConfig `json:"trustedProxy"`
+	// GRPC is the address to serve Envoy external authorization gRPC API on,
+	// for Envoy and Istio ext_authz filter.
+	GRPC string `json:"grpc"`
+	// Admin serves the API for operators to list and revoke sessions.
+	Admin Admin `json:"admin"`
+	// List of allowed origins for CORS requests, requests to userinfo may include
+	// credentials. If none are indicated, CORS requests are disabled. Passing in "*"
+	// will allow any domain, but without credentials to userinfo.
 	AllowedOrigins []string `json:"allowedOrigins"`
 }
 
+// Admin is the config of the admin API, it should listen on an address
+// which is not exposed to users.
+type Admin struct {
+	// HTTP is the address to serve the admin API on.
+	HTTP string `json:"http"`
+	// Token is the bearer token admin requests must present.
+	Token string `json:"token"`
+}
+
+// Providers is a list of oidc providers, the first one is the default provider.
+// A single provider may be configured without list for backward compatibility.
+type Providers []OIDC
+
+func (p *Providers) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '{' {
+		var o OIDC
+		if err := json.Unmarshal(b, &o); err != nil {
+			return err
+		}
+		*p = Providers{o}
+		return nil
+	}
+
+	var providers []OIDC
+	if err := json.Unmarshal(b, &providers); err != nil {
+		return err
+	}
+	*p = providers
+	return nil
+}
+
 // OIDC is the config for authorization handlers with oidc provider
 type OIDC struct {
+	// Name identifies the provider in sessions and the login chooser.
+	// Required if there are more than one providers.
+	Name string `json:"name"`
+	// Hosts selects this provider for requests to any of the host patterns,
+	// a leading "*." matches any subdomain.
+	// Optional.
+	Hosts []string `json:"hosts"`
+	// PathPrefixes selects this provider for requests to any of the path prefixes.
+	// Users choose a provider by themselves if no provider is selected for the request.
+	// Optional.
+	PathPrefixes []string `json:"pathPrefixes"`
 	// This is used when requests Dex in same cluster to avoid from api gateway or external load balancer.
 	// Optional.
 	// TODO: rename to IdPServer?
@@ -99,8 +310,16 @@ type OIDC struct {
 	// Required.
 	ClientID string `json:"clientID"`
 	// OAuth2 client secret of this application
-	// Required.
+	// Required unless PublicClient is set.
 	ClientSecret string `json:"clientSecret"`
+	// PublicClient indicates this application is registered as a public client,
+	// which has no client secret and relies on PKCE to protect the code exchange.
+	// Optional.
+	PublicClient bool `json:"publicClient"`
+	// Proof Key for Code Exchange (RFC 7636) is used by default,
+	// DisablePKCE turns it off for providers which don't support it.
+	// Optional.
+	DisablePKCE bool `json:"disablePKCE"`
 	// Scope specifies optional requested permissions
 	Scopes []string `json:"scopes"`
 	// If your application needs to refresh access tokens when the user
@@ -114,6 +333,23 @@ type OIDC struct {
 	// groups with an ID Token field. If the GroupsClaim field is present in an ID Token the value
 	// must be a string or list of strings.
 	GroupsClaim string `json:"groupsClaim"`
+	// StoreAccessToken stores the access token in session, it's required by
+	// rules forwarding access token to upstream.
+	// Optional.
+	StoreAccessToken bool `json:"storeAccessToken"`
+	// UserInfo fetches claims from the UserInfo endpoint with the access token after
+	// login and refresh, and merges them with the ID token claims. The sub claims of
+	// both must match.
+	// Optional.
+	UserInfo bool `json:"userInfo"`
+	// UserInfoPrecedence is either id_token or userinfo, which decides whose claim is
+	// kept if a claim is present in both, default to id_token.
+	// Optional.
+	UserInfoPrecedence server.UserInfoPrecedence `json:"userInfoPrecedence"`
+	// PostLogoutRedirectURIs are the allowed URIs to redirect to after logout,
+	// they must be registered at provider as well.
+	// Optional.
+	PostLogoutRedirectURIs []string `json:"postLogoutRedirectURIs"`
 }
 
 // Storage holds app's storage configuration.
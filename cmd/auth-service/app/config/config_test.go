@@ -8,8 +8,10 @@ import (
 	"github.com/kylelemons/godebug/pretty"
 
 	"github.com/fezho/oidc-auth/cmd/auth-service/app/config"
+	"github.com/fezho/oidc-auth/server"
 	"github.com/fezho/oidc-auth/storage"
 	"github.com/fezho/oidc-auth/storage/bolt"
+	"github.com/fezho/oidc-auth/storage/memory"
 	"github.com/fezho/oidc-auth/storage/redis"
 )
 
@@ -118,13 +120,13 @@ func TestValidConfiguration(t *testing.T) {
 		Web: config.Web{
 			HTTP: "localhost:8000",
 		},
-		OIDC: config.OIDC{
+		OIDC: config.Providers{{
 			Issuer:        "dex.io/dex",
 			RedirectURL:   "auth-service:8080/callback",
 			ClientID:      "my-app",
 			ClientSecret:  "my-secret",
 			UsernameClaim: "email",
-		},
+		}},
 		Storage: config.Storage{
 			Type: "bolt",
 			Config: &bolt.Config{
@@ -144,6 +146,21 @@ func TestValidConfiguration(t *testing.T) {
 	if err := cfg.Validate(); err != nil {
 		t.Fatalf("this configuration should have been valid: %v", err)
 	}
+
+	cfg.Web.Admin.HTTP = "localhost:8001"
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("admin API without token should have been invalid")
+	}
+	wanted := `invalid Config:
+	-	no token specified for admin API`
+	if got := err.Error(); got != wanted {
+		t.Fatalf("Expected error message to be %q, got %q", wanted, got)
+	}
+	cfg.Web.Admin.Token = "admin-token"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("this configuration should have been valid: %v", err)
+	}
 }
 
 func TestInValidConfiguration(t *testing.T) {
@@ -155,11 +172,7 @@ func TestInValidConfiguration(t *testing.T) {
 
 	got := err.Error()
 	wanted := `invalid Config:
-	-	no openID connect issuer specified
-	-	no openID connect redirect url specified, or trailing slash is not allowed
-	-	no openID connect client id specified
-	-	no openID connect client secret specified
-	-	no openID connect user name claim specified
+	-	no openID connect provider specified
 	-	no storage supplied in config file
 	-	must supply a HTTP/HTTPS  address to listen on`
 	if got != wanted {
@@ -167,3 +180,498 @@ func TestInValidConfiguration(t *testing.T) {
 		t.Fatalf("Expected error message to be %q, got %q", wanted, got)
 	}
 }
+
+func TestPublicClientConfiguration(t *testing.T) {
+	cfg := config.Config{
+		Web: config.Web{
+			HTTP: "localhost:8000",
+		},
+		OIDC: config.Providers{{
+			Issuer:        "dex.io/dex",
+			RedirectURL:   "auth-service:8080/callback",
+			ClientID:      "my-app",
+			PublicClient:  true,
+			UsernameClaim: "email",
+		}},
+		Storage: config.Storage{
+			Type:   "memory",
+			Config: &memory.Config{},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("this configuration should have been valid: %v", err)
+	}
+
+	cfg.Rules = []server.Rule{{Paths: []string{"/api/"}, ForwardToken: server.ForwardAccessToken}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("forwarding access token which is not stored should have been invalid")
+	}
+	cfg.OIDC[0].StoreAccessToken = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("this configuration should have been valid: %v", err)
+	}
+
+	cfg.Rules = nil
+	cfg.OIDC[0].DisablePKCE = true
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("public client without PKCE should have been invalid")
+	}
+	wanted := `invalid Config:
+	-	PKCE can't be disabled for openID connect public client`
+	if got := err.Error(); got != wanted {
+		t.Fatalf("Expected error message to be %q, got %q", wanted, got)
+	}
+}
+
+func TestLoadProviders(t *testing.T) {
+	tests := []struct {
+		rawConfig []byte
+		want      config.Providers
+	}{
+		{
+			rawConfig: []byte(`
+oidc:
+  issuer: https://dex.example.com
+  clientID: auth-service
+`),
+			want: config.Providers{
+				{Issuer: "https://dex.example.com", ClientID: "auth-service"},
+			},
+		},
+		{
+			rawConfig: []byte(`
+oidc:
+  - name: corp
+    issuer: https://login.microsoftonline.com/tenant/v2.0
+    clientID: auth-service
+    hosts: ["*.corp.example.com"]
+  - name: partner
+    issuer: https://keycloak.partner.com/auth/realms/partner
+    clientID: auth-service
+    pathPrefixes: ["/partner/"]
+`),
+			want: config.Providers{
+				{
+					Name:     "corp",
+					Issuer:   "https://login.microsoftonline.com/tenant/v2.0",
+					ClientID: "auth-service",
+					Hosts:    []string{"*.corp.example.com"},
+				},
+				{
+					Name:         "partner",
+					Issuer:       "https://keycloak.partner.com/auth/realms/partner",
+					ClientID:     "auth-service",
+					PathPrefixes: []string{"/partner/"},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		c, err := config.LoadConfig(test.rawConfig)
+		if err != nil {
+			t.Fatalf("failed to load config: %v", err)
+		}
+		if diff := pretty.Compare(c.OIDC, test.want); diff != "" {
+			t.Errorf("got!=want: %s", diff)
+		}
+	}
+}
+
+func TestInvalidProviders(t *testing.T) {
+	provider := config.OIDC{
+		Issuer:        "dex.io/dex",
+		RedirectURL:   "auth-service:8080/callback",
+		ClientID:      "my-app",
+		ClientSecret:  "my-secret",
+		UsernameClaim: "email",
+	}
+	corp, partner := provider, provider
+	corp.Name = "corp"
+
+	cfg := config.Config{
+		Web: config.Web{
+			HTTP: "localhost:8000",
+		},
+		OIDC: config.Providers{corp, partner, corp},
+		Storage: config.Storage{
+			Type:   "memory",
+			Config: &memory.Config{},
+		},
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("providers without unique names should have been invalid")
+	}
+	wanted := `invalid Config:
+	-	no openID connect provider name specified for multiple providers
+	-	duplicate openID connect provider name "corp"`
+	if got := err.Error(); got != wanted {
+		t.Fatalf("Expected error message to be %q, got %q", wanted, got)
+	}
+
+	partner.Name = "partner"
+	partner.UserInfo = true
+	partner.UserInfoPrecedence = "access_token"
+	cfg.OIDC = config.Providers{corp, partner}
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("unknown userinfo precedence should have been invalid")
+	}
+	wanted = `invalid Config:
+	-	provider "partner": unknown userinfo precedence "access_token"`
+	if got := err.Error(); got != wanted {
+		t.Fatalf("Expected error message to be %q, got %q", wanted, got)
+	}
+}
+
+func TestLoadVirtualHosts(t *testing.T) {
+	rawConfig := []byte(`
+virtualHosts:
+  - hosts: ["app.example.com", "*.app.example.com"]
+    oidc:
+      issuer: https://dex.example.com
+      redirectURL: https://app.example.com/oauth2/callback
+      clientID: app
+      clientSecret: app-secret
+      usernameClaim: email
+    cookie:
+      name: app.session
+      domain: app.example.com
+    rules:
+      - paths: ["/public/"]
+        action: public
+`)
+
+	want := []config.VirtualHost{
+		{
+			Hosts: []string{"app.example.com", "*.app.example.com"},
+			OIDC: config.Providers{{
+				Issuer:        "https://dex.example.com",
+				RedirectURL:   "https://app.example.com/oauth2/callback",
+				ClientID:      "app",
+				ClientSecret:  "app-secret",
+				UsernameClaim: "email",
+			}},
+			Rules: []server.Rule{
+				{Paths: []string{"/public/"}, Action: server.ActionPublic},
+			},
+			Cookie: server.CookieConfig{
+				Name:   "app.session",
+				Domain: "app.example.com",
+			},
+		},
+	}
+
+	c, err := config.LoadConfig(rawConfig)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if diff := pretty.Compare(c.VirtualHosts, want); diff != "" {
+		t.Errorf("got!=want: %s", diff)
+	}
+}
+
+func TestInvalidVirtualHosts(t *testing.T) {
+	cfg := config.Config{
+		Web: config.Web{
+			HTTP: "localhost:8000",
+		},
+		OIDC: config.Providers{{
+			Issuer:        "dex.io/dex",
+			RedirectURL:   "auth-service:8080/callback",
+			ClientID:      "my-app",
+			ClientSecret:  "my-secret",
+			UsernameClaim: "email",
+		}},
+		Storage: config.Storage{
+			Type:   "memory",
+			Config: &memory.Config{},
+		},
+		VirtualHosts: []config.VirtualHost{
+			{OIDC: config.Providers{{}}},
+			{Hosts: []string{"app.example.com"}},
+		},
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("virtual hosts should have been invalid")
+	}
+	wanted := `invalid Config:
+	-	no hosts specified for virtual host 0
+	-	virtual host "app.example.com": no openID connect provider specified`
+	if got := err.Error(); got != wanted {
+		t.Fatalf("Expected error message to be %q, got %q", wanted, got)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	rawConfig := []byte(`
+rules:
+  - paths: ["/static/", "/healthz"]
+    action: public
+  - pathRegexes: ["/hooks/[a-z]+"]
+    methods: ["POST"]
+    hosts: ["*.example.com"]
+    action: public
+  - paths: ["/admin"]
+    action: deny
+  - paths: ["/reports"]
+    expression: "'admins' in groups || claims.email.endsWith('@corp.com')"
+`)
+
+	want := []server.Rule{
+		{
+			Paths:  []string{"/static/", "/healthz"},
+			Action: server.ActionPublic,
+		},
+		{
+			PathRegexes: []string{"/hooks/[a-z]+"},
+			Methods:     []string{"POST"},
+			Hosts:       []string{"*.example.com"},
+			Action:      server.ActionPublic,
+		},
+		{
+			Paths:  []string{"/admin"},
+			Action: server.ActionDeny,
+		},
+		{
+			Paths:      []string{"/reports"},
+			Expression: "'admins' in groups || claims.email.endsWith('@corp.com')",
+		},
+	}
+
+	c, err := config.LoadConfig(rawConfig)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if diff := pretty.Compare(c.Rules, want); diff != "" {
+		t.Errorf("got!=want: %s", diff)
+	}
+	if err := server.ValidateRules(c.Rules); err != nil {
+		t.Errorf("rules should have been valid: %v", err)
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	tests := []struct {
+		rules  []server.Rule
+		errMsg string
+	}{
+		{
+			rules:  []server.Rule{{Paths: []string{"/"}, Action: "allow"}},
+			errMsg: `rule 0: unknown action "allow"`,
+		},
+		{
+			rules:  []server.Rule{{Action: server.ActionPublic, AnyGroups: []string{"admins"}}},
+			errMsg: "rule 0: authorization policies require authenticated action",
+		},
+		{
+			rules:  []server.Rule{{Expression: "claims.email"}},
+			errMsg: `rule 0: invalid expression "claims.email": expression must evaluate to bool`,
+		},
+		{
+			rules:  []server.Rule{{Paths: []string{"/static/"}, Action: server.ActionPublic, ForwardToken: server.ForwardIDToken}},
+			errMsg: "rule 0: token forwarding requires authenticated action",
+		},
+		{
+			rules:  []server.Rule{{ForwardToken: "refresh_token"}},
+			errMsg: `rule 0: unknown token to forward "refresh_token"`,
+		},
+		{
+			rules:  []server.Rule{{}, {PathRegexes: []string{"/api/("}}},
+			errMsg: "rule 1: invalid path regex \"/api/(\": error parsing regexp: missing closing ): `^(?:/api/()$`",
+		},
+	}
+
+	for _, test := range tests {
+		err := server.ValidateRules(test.rules)
+		if err == nil {
+			t.Fatalf("rules %v should have been invalid", test.rules)
+		}
+		if got := err.Error(); got != test.errMsg {
+			t.Errorf("Expected error message to be %q, got %q", test.errMsg, got)
+		}
+	}
+}
+
+func TestInvalidHeaders(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		errMsg  string
+	}{
+		{
+			headers: map[string]string{"X-Email": "{{ lower .email }}", "X-Roles": `{{ join "," .roles }}`},
+		},
+		{
+			headers: map[string]string{"X Email": "{{ .email }}"},
+			errMsg:  `invalid header name "X Email"`,
+		},
+		{
+			headers: map[string]string{"X-Name": "{{ .name | upper }}"},
+			errMsg:  `header "X-Name": template: X-Name:1: function "upper" not defined`,
+		},
+	}
+
+	for _, test := range tests {
+		err := server.ValidateHeaders(test.headers)
+		if test.errMsg == "" {
+			if err != nil {
+				t.Errorf("headers %v should have been valid: %v", test.headers, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("headers %v should have been invalid", test.headers)
+		}
+		if got := err.Error(); got != test.errMsg {
+			t.Errorf("Expected error message to be %q, got %q", test.errMsg, got)
+		}
+	}
+}
+
+func TestInvalidAssertion(t *testing.T) {
+	tests := []struct {
+		assertion server.AssertionConfig
+		errMsg    string
+	}{
+		{
+			assertion: server.AssertionConfig{Audiences: []string{"upstream"}},
+			errMsg:    "assertion: no signing keys",
+		},
+		{
+			assertion: server.AssertionConfig{Keys: []server.SigningKey{{ID: "2020-05"}}},
+			errMsg:    "assertion: id and file are required for signing keys",
+		},
+		{
+			assertion: server.AssertionConfig{
+				Keys:         []server.SigningKey{{ID: "2020-05", File: "/etc/oidc-auth/keys/2020-05.pem"}},
+				SigningKeyID: "2020-06",
+			},
+			errMsg: `assertion: no signing key of id "2020-06"`,
+		},
+	}
+
+	for _, test := range tests {
+		err := test.assertion.Validate()
+		if err == nil {
+			t.Fatalf("assertion %v should have been invalid", test.assertion)
+		}
+		if got := err.Error(); got != test.errMsg {
+			t.Errorf("Expected error message to be %q, got %q", test.errMsg, got)
+		}
+	}
+}
+
+func TestInvalidTrustedProxy(t *testing.T) {
+	tests := []struct {
+		proxy  server.TrustedProxyConfig
+		errMsg string
+	}{
+		{
+			proxy: server.TrustedProxyConfig{Preset: "nginx", CIDRs: []string{"10.0.0.0/8", "127.0.0.1", "::1"}},
+		},
+		{
+			proxy:  server.TrustedProxyConfig{Preset: "haproxy", CIDRs: []string{"10.0.0.0/8"}},
+			errMsg: `trusted proxy: unknown preset "haproxy"`,
+		},
+		{
+			proxy:  server.TrustedProxyConfig{Preset: "traefik"},
+			errMsg: "trusted proxy: no CIDRs of traefik",
+		},
+		{
+			proxy:  server.TrustedProxyConfig{Preset: "caddy", CIDRs: []string{"10.0.0.0/33"}},
+			errMsg: "trusted proxy: invalid CIDR address: 10.0.0.0/33",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.proxy.Validate()
+		if test.errMsg == "" {
+			if err != nil {
+				t.Errorf("trusted proxy %v should have been valid: %v", test.proxy, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("trusted proxy %v should have been invalid", test.proxy)
+		}
+		if got := err.Error(); got != test.errMsg {
+			t.Errorf("Expected error message to be %q, got %q", test.errMsg, got)
+		}
+	}
+}
+
+func TestInvalidAPI(t *testing.T) {
+	tests := []struct {
+		api    server.APIConfig
+		errMsg string
+	}{
+		{
+			api: server.APIConfig{PathPrefixes: []string{"/api/", "/graphql"}},
+		},
+		{
+			api:    server.APIConfig{PathPrefixes: []string{"api/"}},
+			errMsg: `api: path prefix "api/" must start with /`,
+		},
+	}
+
+	for _, test := range tests {
+		err := test.api.Validate()
+		if test.errMsg == "" {
+			if err != nil {
+				t.Errorf("api %v should have been valid: %v", test.api, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("api %v should have been invalid", test.api)
+		}
+		if got := err.Error(); got != test.errMsg {
+			t.Errorf("Expected error message to be %q, got %q", test.errMsg, got)
+		}
+	}
+}
+
+func TestInvalidSessionLimit(t *testing.T) {
+	tests := []struct {
+		limit  server.SessionLimitConfig
+		errMsg string
+	}{
+		{
+			limit: server.SessionLimitConfig{MaxSessions: 1},
+		},
+		{
+			limit: server.SessionLimitConfig{MaxSessions: 3, Eviction: server.EvictRefuse},
+		},
+		{
+			limit:  server.SessionLimitConfig{MaxSessions: -1},
+			errMsg: "session limit: maxSessions must not be negative",
+		},
+		{
+			limit:  server.SessionLimitConfig{MaxSessions: 1, Eviction: "newest"},
+			errMsg: `session limit: unknown eviction "newest"`,
+		},
+		{
+			limit:  server.SessionLimitConfig{Eviction: server.EvictOldest},
+			errMsg: "session limit: eviction requires maxSessions",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.limit.Validate()
+		if test.errMsg == "" {
+			if err != nil {
+				t.Errorf("session limit %v should have been valid: %v", test.limit, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("session limit %v should have been invalid", test.limit)
+		}
+		if got := err.Error(); got != test.errMsg {
+			t.Errorf("Expected error message to be %q, got %q", test.errMsg, got)
+		}
+	}
+}
@@ -3,12 +3,15 @@ package app
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
 
 	"github.com/fezho/oidc-auth/cmd/auth-service/app/config"
 	"github.com/fezho/oidc-auth/cmd/auth-service/app/options"
@@ -68,7 +71,7 @@ func runCommand(cmd *cobra.Command, args []string, opts *options.Options) error
 	}
 
 	// initiate session storage
-	if strings.HasPrefix(c.OIDC.RedirectURL, "https") {
+	if strings.HasPrefix(c.OIDC[0].RedirectURL, "https") {
 		// set secureCookie if the scheme of the RedirectURL is https
 		c.Storage.Config.SetSecureCookie(true)
 	}
@@ -79,17 +82,40 @@ func runCommand(cmd *cobra.Command, args []string, opts *options.Options) error
 	defer storage.Close()
 
 	serverConfig := server.Config{
-		DexAddress:     c.OIDC.DexAddress,
-		IssuerURL:      c.OIDC.Issuer,
-		RedirectURL:    c.OIDC.RedirectURL,
-		ClientID:       c.OIDC.ClientID,
-		ClientSecret:   c.OIDC.ClientSecret,
-		Scopes:         c.OIDC.Scopes,
-		UsernameClaim:  c.OIDC.UsernameClaim,
-		GroupsClaim:    c.OIDC.GroupsClaim,
+		Providers:      providerConfigs(c.OIDC),
 		Store:          storage,
 		AllowedOrigins: c.Web.AllowedOrigins,
-		OfflineAccess:  c.OIDC.OfflineAccess,
+		TrustedProxy:   c.Web.TrustedProxy,
+		Rules:          c.Rules,
+		Bearer:         c.Bearer,
+		Headers:        c.Headers,
+		Assertion:      c.Assertion,
+		Redirect:       c.Redirect,
+		API:            c.API,
+		SessionInfo:    c.SessionInfo,
+		SessionLimit:   c.SessionLimit,
+		Cookie:         c.Cookie,
+	}
+	for _, vhost := range c.VirtualHosts {
+		cookie := vhost.Cookie
+		if strings.HasPrefix(vhost.OIDC[0].RedirectURL, "https") {
+			cookie.Secure = true
+		}
+		serverConfig.VirtualHosts = append(serverConfig.VirtualHosts, server.VirtualHost{
+			Hosts: vhost.Hosts,
+			Config: server.Config{
+				Providers: providerConfigs(vhost.OIDC),
+				Rules:     vhost.Rules,
+				Bearer:    vhost.Bearer,
+				Headers:   vhost.Headers,
+				Assertion: vhost.Assertion,
+				Redirect:  vhost.Redirect,
+				API:       vhost.API,
+				Cookie:    cookie,
+
+				SessionInfo: vhost.SessionInfo,
+			},
+		})
 	}
 
 	srv, err := server.NewServer(serverConfig)
@@ -97,7 +123,7 @@ func runCommand(cmd *cobra.Command, args []string, opts *options.Options) error
 		log.Fatal("failed to create auth server, ", err)
 	}
 
-	errc := make(chan error, 3)
+	errc := make(chan error, 4)
 
 	if c.Web.HTTP != "" {
 		log.Infof("listening (http) on %s", c.Web.HTTP)
@@ -124,6 +150,34 @@ func runCommand(cmd *cobra.Command, args []string, opts *options.Options) error
 		}()
 	}
 
+	if c.Web.GRPC != "" {
+		lis, err := net.Listen("tcp", c.Web.GRPC)
+		if err != nil {
+			return fmt.Errorf("listening on %s failed: %v", c.Web.GRPC, err)
+		}
+		grpcSrv := grpc.NewServer()
+		auth.RegisterAuthorizationServer(grpcSrv, server.NewAuthorizationServer(srv))
+
+		log.Infof("listening (grpc) on %s", c.Web.GRPC)
+		go func() {
+			err := grpcSrv.Serve(lis)
+			errc <- fmt.Errorf("listening on %s failed: %v", c.Web.GRPC, err)
+		}()
+	}
+
+	if c.Web.Admin.HTTP != "" {
+		adminHandler, err := server.NewAdminHandler(srv, c.Web.Admin.Token)
+		if err != nil {
+			return fmt.Errorf("oidc-auth: %v", err)
+		}
+
+		log.Infof("listening (admin) on %s", c.Web.Admin.HTTP)
+		go func() {
+			err := http.ListenAndServe(c.Web.Admin.HTTP, adminHandler)
+			errc <- fmt.Errorf("listening on %s failed: %v", c.Web.Admin.HTTP, err)
+		}()
+	}
+
 	return <-errc
 }
 
@@ -159,3 +213,31 @@ func initLogger(config config.Logger) error {
 
 	return nil
 }
+
+func providerConfigs(providers config.Providers) []server.ProviderConfig {
+	configs := make([]server.ProviderConfig, 0, len(providers))
+	for _, p := range providers {
+		configs = append(configs, server.ProviderConfig{
+			Name:          p.Name,
+			DexAddress:    p.DexAddress,
+			IssuerURL:     p.Issuer,
+			RedirectURL:   p.RedirectURL,
+			ClientID:      p.ClientID,
+			ClientSecret:  p.ClientSecret,
+			Scopes:        p.Scopes,
+			UsernameClaim: p.UsernameClaim,
+			GroupsClaim:   p.GroupsClaim,
+			OfflineAccess: p.OfflineAccess,
+			DisablePKCE:   p.DisablePKCE,
+			PublicClient:  p.PublicClient,
+			Hosts:         p.Hosts,
+			PathPrefixes:  p.PathPrefixes,
+			UserInfo:      p.UserInfo,
+
+			StoreAccessToken:       p.StoreAccessToken,
+			UserInfoPrecedence:     p.UserInfoPrecedence,
+			PostLogoutRedirectURIs: p.PostLogoutRedirectURIs,
+		})
+	}
+	return configs
+}
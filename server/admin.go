@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionAdmin is implemented by session stores which can list and revoke sessions.
+type SessionAdmin interface {
+	SessionIndex
+	// List returns the ids of all the sessions.
+	List() ([]string, error)
+	// ListIndexed returns the ids of existing sessions in the index of key.
+	ListIndexed(key string) ([]string, error)
+	// Lookup loads the session of id, it returns false if the session doesn't exist.
+	Lookup(id string) (*sessions.Session, bool, error)
+	// Remove deletes the session of id.
+	Remove(id string) error
+}
+
+// adminSession describes a session to operators, tokens are never included.
+type adminSession struct {
+	ID          string     `json:"id"`
+	User        string     `json:"user"`
+	Groups      []string   `json:"groups,omitempty"`
+	Provider    string     `json:"provider,omitempty"`
+	Issuer      string     `json:"issuer,omitempty"`
+	Subject     string     `json:"sub,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Refreshable bool       `json:"refreshable"`
+}
+
+func newAdminSession(session *sessions.Session) adminSession {
+	id := identityFromSession(session)
+	info := adminSession{
+		ID:     session.ID,
+		User:   id.username,
+		Groups: id.groups,
+	}
+	info.Provider, _ = session.Values["provider"].(string)
+	info.Issuer, _ = session.Values["issuer"].(string)
+	info.Subject, _ = session.Values["sub"].(string)
+	if !id.createdAt.IsZero() {
+		info.CreatedAt = &id.createdAt
+	}
+	if expiry, ok := session.Values["expiry"].(int64); ok {
+		expiresAt := time.Unix(expiry, 0)
+		info.ExpiresAt = &expiresAt
+	}
+	refresh, _ := session.Values["refresh-token"].(string)
+	info.Refreshable = refresh != ""
+	return info
+}
+
+// admin serves the API for operators to list and revoke sessions.
+type admin struct {
+	store SessionAdmin
+	token string
+}
+
+// NewAdminHandler returns the admin API of the server's sessions, which is meant to be
+// served on a separate listener. Requests must present the token as bearer token.
+//
+//	GET    /sessions                list all sessions, or sessions of ?user=
+//	GET    /sessions/{id}           get a session
+//	DELETE /sessions/{id}           revoke a session
+//	GET    /users/{user}/sessions   list sessions of a user
+//	DELETE /users/{user}/sessions   revoke all sessions of a user
+func NewAdminHandler(s *Server, token string) (http.Handler, error) {
+	if token == "" {
+		return nil, errors.New("server: no admin token")
+	}
+	store, ok := s.store.(SessionAdmin)
+	if !ok {
+		return nil, errors.New("server: session admin is not supported by session storage")
+	}
+
+	a := &admin{store: store, token: token}
+	router := mux.NewRouter()
+	router.HandleFunc("/sessions", a.listSessions).Methods(http.MethodGet)
+	router.HandleFunc("/sessions/{id}", a.getSession).Methods(http.MethodGet)
+	router.HandleFunc("/sessions/{id}", a.deleteSession).Methods(http.MethodDelete)
+	router.HandleFunc("/users/{user}/sessions", a.listUserSessions).Methods(http.MethodGet)
+	router.HandleFunc("/users/{user}/sessions", a.deleteUserSessions).Methods(http.MethodDelete)
+	return a.authenticate(router), nil
+}
+
+// authenticate rejects requests without the admin token.
+func (a *admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *admin) listSessions(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	var err error
+	if user := r.URL.Query().Get("user"); user != "" {
+		ids, err = a.store.ListIndexed(userIndexKey(user))
+	} else {
+		ids, err = a.store.List()
+	}
+	if err != nil {
+		log.Errorf("server: admin list sessions: %s", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	a.writeSessions(w, ids)
+}
+
+func (a *admin) listUserSessions(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	ids, err := a.store.ListIndexed(userIndexKey(user))
+	if err != nil {
+		log.Errorf("server: admin list sessions of %s: %s", user, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	a.writeSessions(w, ids)
+}
+
+// writeSessions loads the sessions of ids, sessions deleted in the meantime and
+// sessions without user like login transactions are skipped.
+func (a *admin) writeSessions(w http.ResponseWriter, ids []string) {
+	list := make([]adminSession, 0, len(ids))
+	for _, id := range ids {
+		session, ok, err := a.store.Lookup(id)
+		if err != nil {
+			log.Errorf("server: admin load session: %s", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+			return
+		}
+		if !ok {
+			continue
+		}
+		if _, loggedIn := session.Values["user_name"].(string); loggedIn {
+			list = append(list, newAdminSession(session))
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": list})
+}
+
+func (a *admin) getSession(w http.ResponseWriter, r *http.Request) {
+	session, ok, err := a.store.Lookup(mux.Vars(r)["id"])
+	if err != nil {
+		log.Errorf("server: admin load session: %s", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, newAdminSession(session))
+}
+
+func (a *admin) deleteSession(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	_, ok, err := a.store.Lookup(id)
+	if err == nil && ok {
+		err = a.store.Remove(id)
+	}
+	if err != nil {
+		log.Errorf("server: admin delete session: %s", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+		return
+	}
+
+	log.Infof("server: admin revoked session %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *admin) deleteUserSessions(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	if err := a.store.DeleteIndexed(userIndexKey(user)); err != nil {
+		log.Errorf("server: admin delete sessions of %s: %s", user, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+
+	log.Infof("server: admin revoked sessions of %s", user)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fezho/oidc-auth/storage/memory"
+)
+
+func TestAdminListSessions(t *testing.T) {
+	s := &Server{store: memory.New(), cookie: CookieConfig{Name: defaultSessionName}}
+
+	// a logged in session and a login transaction are both in the store
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := s.authSession(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["user_name"] = "tom"
+	if err := s.saveSession(session, httptest.NewRecorder(), r); err != nil {
+		t.Fatal(err)
+	}
+	txn, err := s.loginSession(r, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLoginTransaction(txn, loginTransaction{createdAt: 1 << 40})
+	if err := txn.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewAdminHandler(s, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/sessions", "/sessions?user=tom", "/users/tom/sessions"} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected code 200, got %d", target, w.Code)
+		}
+
+		var resp struct {
+			Sessions []adminSession `json:"sessions"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Sessions) != 1 || resp.Sessions[0].ID != session.ID || resp.Sessions[0].User != "tom" {
+			t.Errorf("%s: expected only the session of tom, got %+v", target, resp.Sessions)
+		}
+	}
+
+	// sessions deleted or expired after being listed are skipped
+	a := &admin{store: s.store.(SessionAdmin)}
+	w := httptest.NewRecorder()
+	a.writeSessions(w, []string{"deleted", session.ID})
+	var resp struct {
+		Sessions []adminSession `json:"sessions"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(resp.Sessions) != 1 || resp.Sessions[0].ID != session.ID {
+		t.Errorf("expected only the session of tom, got %d %+v", w.Code, resp.Sessions)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// APIConfig configures how unauthenticated API requests are answered. Instead of
+// redirecting to the provider, which fetch/XHR calls can't follow across origins,
+// API requests get a 401 with the URL to start login at.
+type APIConfig struct {
+	// PathPrefixes are prefixes of API paths, matched by whole segments of the
+	// cleaned path. Requests accepting JSON or sent by XMLHttpRequest are treated
+	// as API requests as well.
+	PathPrefixes []string `json:"pathPrefixes"`
+}
+
+// Validate checks the path prefixes are absolute.
+func (c APIConfig) Validate() error {
+	for _, prefix := range c.PathPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("api: path prefix %q must start with /", prefix)
+		}
+	}
+	return nil
+}
+
+// isAPIRequest reports whether the request is sent by an API client rather than
+// a browser navigating to a page.
+func (c APIConfig) isAPIRequest(r *http.Request) bool {
+	if strings.EqualFold(r.Header.Get("X-Requested-With"), "XMLHttpRequest") {
+		return true
+	}
+	if acceptsJSON(r.Header.Get("Accept")) {
+		return true
+	}
+	p := cleanPath(r.URL.Path)
+	for _, prefix := range c.PathPrefixes {
+		if matchPathPrefix(prefix, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsJSON reports whether JSON is preferred over HTML in the Accept header,
+// browsers accept */* as well, which is not taken as accepting JSON.
+func acceptsJSON(accept string) bool {
+	for _, v := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		switch {
+		case mediaType == "text/html":
+			return false
+		case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+			return true
+		}
+	}
+	return false
+}
+
+// unauthenticated answers the API request with 401 and the login URL, which
+// redirects user back to the requested URL after login.
+func (s *Server) unauthenticated(w http.ResponseWriter, r *http.Request) {
+	loginURL := url.URL{
+		Path:     path.Join(s.rootPath, "login"),
+		RawQuery: url.Values{"rd": {r.URL.String()}}.Encode(),
+	}
+	if p := s.selectProvider(r); p != nil && p.name != "" {
+		loginURL.RawQuery = url.Values{"provider": {p.name}, "rd": {r.URL.String()}}.Encode()
+	}
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`OIDC realm=%q, login_url=%q`, r.Host, loginURL.String()))
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	writeJSON(w, http.StatusUnauthorized, map[string]string{
+		"error":     "unauthenticated",
+		"login_url": loginURL.String(),
+	})
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"application/problem+json", true},
+		{"application/json, text/plain, */*", true},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"text/html, application/json", false},
+		{"text/plain, application/json", true},
+		{"invalid;;, application/json", true},
+		{"text/plain", false},
+	}
+	for _, test := range tests {
+		if got := acceptsJSON(test.accept); got != test.want {
+			t.Errorf("acceptsJSON(%q): expected %v, got %v", test.accept, test.want, got)
+		}
+	}
+}
+
+func TestIsAPIRequest(t *testing.T) {
+	c := APIConfig{PathPrefixes: []string{"/api/", "/graphql"}}
+	tests := []struct {
+		path    string
+		headers map[string]string
+		want    bool
+	}{
+		{"/", nil, false},
+		{"/index.html", map[string]string{"Accept": "text/html,*/*"}, false},
+		{"/api/users", nil, true},
+		{"/graphql", nil, true},
+		{"/apis", nil, false},
+		{"/api", nil, true},
+		{"/apidocs", nil, false},
+		{"/graphql/", nil, true},
+		{"/graphqlite", nil, false},
+		{"/x/../api/", nil, true},
+		{"/api/../index.html", nil, false},
+		{"//api/users", nil, true},
+		{"/", map[string]string{"X-Requested-With": "XMLHttpRequest"}, true},
+		{"/", map[string]string{"X-Requested-With": "xmlhttprequest"}, true},
+		{"/", map[string]string{"X-Requested-With": "Fetch"}, false},
+		{"/", map[string]string{"Accept": "application/json"}, true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		if got := c.isAPIRequest(r); got != test.want {
+			t.Errorf("isAPIRequest(%s %v): expected %v, got %v", test.path, test.headers, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	defaultAssertionHeader = "X-Auth-Assertion"
+	defaultAssertionIssuer = "oidc-auth"
+	// defaultAssertionTTL is the lifetime of assertions in seconds.
+	defaultAssertionTTL = 300
+)
+
+// registeredClaims are set by asserter, they can't be copied from user claims.
+var registeredClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true,
+}
+
+// AssertionConfig configures the signed JWT issued to upstreams for authorized
+// requests, which asserts the identity of user without forwarding IdP tokens.
+type AssertionConfig struct {
+	// Header of the assertion in auth responses, default to X-Auth-Assertion.
+	Header string `json:"header"`
+	// Issuer is the iss claim of the assertion, default to oidc-auth.
+	Issuer string `json:"issuer"`
+	// Audiences are the aud claim of the assertion.
+	Audiences []string `json:"audiences"`
+	// Claims are names of the verified claims copied into the assertion,
+	// sub is always the user name, and groups are included if any.
+	Claims []string `json:"claims"`
+	// TTL is the lifetime of the assertion in seconds, default to 300.
+	TTL int `json:"ttl"`
+	// Keys are the signing keys, all of them are published in JWKS, so that a new
+	// key could be published before signing with it.
+	Keys []SigningKey `json:"keys"`
+	// SigningKeyID is the id of the key to sign with, default to the first key.
+	SigningKeyID string `json:"signingKeyID"`
+}
+
+// SigningKey is a RSA or ECDSA private key in PEM file.
+type SigningKey struct {
+	// ID is the kid of the key, required.
+	ID string `json:"id"`
+	// File is the path of the PEM encoded private key.
+	File string `json:"file"`
+}
+
+// Enabled reports whether assertions are issued.
+func (c AssertionConfig) Enabled() bool {
+	return len(c.Keys) > 0
+}
+
+// Validate checks the config without loading the keys.
+func (c AssertionConfig) Validate() error {
+	if !c.Enabled() {
+		if c.SigningKeyID != "" || len(c.Audiences) > 0 || len(c.Claims) > 0 {
+			return errors.New("assertion: no signing keys")
+		}
+		return nil
+	}
+
+	found := c.SigningKeyID == ""
+	for _, k := range c.Keys {
+		if k.ID == "" || k.File == "" {
+			return errors.New("assertion: id and file are required for signing keys")
+		}
+		found = found || k.ID == c.SigningKeyID
+	}
+	if !found {
+		return fmt.Errorf("assertion: no signing key of id %q", c.SigningKeyID)
+	}
+	if c.TTL < 0 {
+		return errors.New("assertion: ttl must not be negative")
+	}
+	return nil
+}
+
+// asserter mints assertions and publishes the public keys.
+type asserter struct {
+	header    string
+	issuer    string
+	audiences []string
+	claims    []string
+	ttl       time.Duration
+
+	signer jose.Signer
+	jwks   []byte
+}
+
+func newAsserter(c AssertionConfig) (*asserter, error) {
+	a := &asserter{
+		header:    c.Header,
+		issuer:    c.Issuer,
+		audiences: c.Audiences,
+		claims:    c.Claims,
+		ttl:       time.Duration(c.TTL) * time.Second,
+	}
+	if a.header == "" {
+		a.header = defaultAssertionHeader
+	}
+	if a.issuer == "" {
+		a.issuer = defaultAssertionIssuer
+	}
+	if c.TTL <= 0 {
+		a.ttl = defaultAssertionTTL * time.Second
+	}
+
+	signingKeyID := c.SigningKeyID
+	if signingKeyID == "" {
+		signingKeyID = c.Keys[0].ID
+	}
+
+	var keySet jose.JSONWebKeySet
+	ids := make(map[string]bool)
+	for _, k := range c.Keys {
+		if k.ID == "" {
+			return nil, errors.New("signing key has no id")
+		}
+		if ids[k.ID] {
+			return nil, fmt.Errorf("duplicate signing key id %q", k.ID)
+		}
+		ids[k.ID] = true
+
+		jwk, err := loadSigningKey(k)
+		if err != nil {
+			return nil, err
+		}
+		keySet.Keys = append(keySet.Keys, jwk.Public())
+
+		if k.ID == signingKeyID {
+			opts := (&jose.SignerOptions{}).WithType("JWT")
+			signingKey := jose.SigningKey{Algorithm: jose.SignatureAlgorithm(jwk.Algorithm), Key: jwk}
+			if a.signer, err = jose.NewSigner(signingKey, opts); err != nil {
+				return nil, fmt.Errorf("signing key %q: %v", k.ID, err)
+			}
+		}
+	}
+	if a.signer == nil {
+		return nil, fmt.Errorf("no signing key of id %q", signingKeyID)
+	}
+
+	jwks, err := json.Marshal(keySet)
+	if err != nil {
+		return nil, err
+	}
+	a.jwks = jwks
+	return a, nil
+}
+
+// loadSigningKey reads the private key in PEM file, and picks the algorithm by its type.
+func loadSigningKey(k SigningKey) (*jose.JSONWebKey, error) {
+	data, err := ioutil.ReadFile(k.File)
+	if err != nil {
+		return nil, fmt.Errorf("signing key %q: %v", k.ID, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %q: no PEM data in %s", k.ID, k.File)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signing key %q: %v", k.ID, err)
+	}
+
+	jwk := &jose.JSONWebKey{Key: key, KeyID: k.ID, Use: "sig"}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		jwk.Algorithm = string(jose.RS256)
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			jwk.Algorithm = string(jose.ES256)
+		case elliptic.P384():
+			jwk.Algorithm = string(jose.ES384)
+		case elliptic.P521():
+			jwk.Algorithm = string(jose.ES512)
+		default:
+			return nil, fmt.Errorf("signing key %q: unsupported curve %s", k.ID, key.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("signing key %q: unsupported key type %T", k.ID, key)
+	}
+	return jwk, nil
+}
+
+// mint issues a signed assertion of the identity.
+func (a *asserter) mint(id *identity) (string, error) {
+	now := time.Now()
+	std := jwt.Claims{
+		Issuer:    a.issuer,
+		Subject:   id.username,
+		Audience:  jwt.Audience(a.audiences),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(a.ttl)),
+	}
+
+	extra := make(map[string]interface{}, len(a.claims)+1)
+	for _, name := range a.claims {
+		if registeredClaims[name] {
+			continue
+		}
+		if val, ok := id.claims[name]; ok {
+			extra[name] = val
+		}
+	}
+	if len(id.groups) > 0 {
+		extra["groups"] = id.groups
+	}
+
+	return jwt.Signed(a.signer).Claims(std).Claims(extra).CompactSerialize()
+}
+
+// jwksHandler serves the public keys of assertions.
+func (a *asserter) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if _, err := w.Write(a.jwks); err != nil {
+		log.Debugf("server: write jwks: %s", err)
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/fezho/oidc-auth/storage/memory"
+)
+
+// writeKeyFile writes the DER encoded key as PEM block of the type into dir.
+func writeKeyFile(t *testing.T, dir, name, typ string, der []byte) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func marshalPKCS8(t *testing.T, key crypto.PrivateKey) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "assertion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		typ     string
+		der     []byte
+		wantAlg jose.SignatureAlgorithm
+	}{
+		{"rsa pkcs1", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), jose.RS256},
+		{"rsa pkcs8", "PRIVATE KEY", marshalPKCS8(t, rsaKey), jose.RS256},
+		{"ec", "EC PRIVATE KEY", ecDER, jose.ES256},
+		{"ec pkcs8", "PRIVATE KEY", marshalPKCS8(t, ec384Key), jose.ES384},
+		// unsupported
+		{"ed25519 pkcs8", "PRIVATE KEY", marshalPKCS8(t, edKey), ""},
+		{"rsa as ec", "EC PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), ""},
+	}
+	for _, test := range tests {
+		file := writeKeyFile(t, dir, test.name+".pem", test.typ, test.der)
+		jwk, err := loadSigningKey(SigningKey{ID: test.name, File: file})
+		if test.wantAlg == "" {
+			if err == nil {
+				t.Errorf("%s: expected key to be rejected", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if jwk.Algorithm != string(test.wantAlg) || jwk.KeyID != test.name || jwk.IsPublic() {
+			t.Errorf("%s: unexpected key of alg %s, id %s", test.name, jwk.Algorithm, jwk.KeyID)
+		}
+	}
+
+	if _, err := loadSigningKey(SigningKey{ID: "missing", File: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("expected missing key file to be rejected")
+	}
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSigningKey(SigningKey{ID: "not pem", File: notPEM}); err == nil {
+		t.Error("expected file without PEM data to be rejected")
+	}
+}
+
+func TestAssertionRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "assertion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := newTestIdP(t)
+	defer idp.Close()
+
+	// assertions are signed by the second key, while both keys are published
+	s, err := NewServer(Config{
+		Providers: []ProviderConfig{idp.config("")},
+		Store:     memory.New(),
+		Bearer:    BearerConfig{Mode: BearerJWT},
+		Assertion: AssertionConfig{
+			Audiences: []string{"upstream"},
+			Claims:    []string{"email", "exp"},
+			TTL:       60,
+			Keys: []SigningKey{
+				{ID: "old", File: writeKeyFile(t, dir, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))},
+				{ID: "new", File: writeKeyFile(t, dir, "ec.pem", "PRIVATE KEY", marshalPKCS8(t, ecKey))},
+			},
+			SigningKeyID: "new",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://app.com/", nil)
+	r.Header.Set("Authorization", "Bearer "+idp.idToken(t, map[string]interface{}{"email": "tom@app.com"}))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected code 200, got %d", w.Code)
+	}
+	assertion := w.Header().Get(defaultAssertionHeader)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://app.com/.well-known/jwks.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected jwks, got code %d", w.Code)
+	}
+	var jwks jose.JSONWebKeySet
+	if err := json.NewDecoder(w.Body).Decode(&jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("expected 2 published keys, got %d", len(jwks.Keys))
+	}
+	for _, key := range jwks.Keys {
+		if !key.IsPublic() {
+			t.Errorf("expected only public keys, got private key %s", key.KeyID)
+		}
+	}
+
+	token, err := jwt.ParseSigned(assertion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := token.Headers[0].KeyID; kid != "new" {
+		t.Fatalf("expected assertion signed by key new, got %q", kid)
+	}
+	keys := jwks.Key(token.Headers[0].KeyID)
+	if len(keys) != 1 {
+		t.Fatalf("expected key of kid in jwks, got %d", len(keys))
+	}
+
+	var std jwt.Claims
+	var extra struct {
+		Email string `json:"email"`
+	}
+	if err := token.Claims(keys[0].Key, &std, &extra); err != nil {
+		t.Fatalf("verify assertion: %v", err)
+	}
+	now := time.Now()
+	if err := std.Validate(jwt.Expected{Issuer: defaultAssertionIssuer, Audience: jwt.Audience{"upstream"}, Subject: "tom", Time: now}); err != nil {
+		t.Errorf("validate assertion: %v", err)
+	}
+	// exp is set by the asserter rather than copied from the ID token
+	if ttl := std.Expiry.Time().Sub(std.IssuedAt.Time()); ttl != time.Minute {
+		t.Errorf("expected assertion to expire in a minute, got %s", ttl)
+	}
+	if extra.Email != "tom@app.com" {
+		t.Errorf("expected email claim copied, got %q", extra.Email)
+	}
+
+	// the other published key doesn't verify the assertion
+	if others := jwks.Key("old"); len(others) != 1 || token.Claims(others[0].Key, &std) == nil {
+		t.Error("expected assertion not to be verified by another key")
+	}
+}
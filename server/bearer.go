@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc"
+)
+
+// BearerMode is the way to validate bearer tokens in Authorization header of auth requests.
+type BearerMode string
+
+const (
+	// BearerNone ignores bearer tokens, it's the default mode.
+	BearerNone BearerMode = ""
+	// BearerJWT verifies bearer tokens as JWTs signed by the provider.
+	BearerJWT BearerMode = "jwt"
+	// BearerIntrospection validates opaque bearer tokens by the provider's
+	// token introspection endpoint.
+	BearerIntrospection BearerMode = "introspection"
+)
+
+// BearerConfig is the config of bearer token validation.
+type BearerConfig struct {
+	// Mode is the way to validate bearer tokens.
+	Mode BearerMode `json:"mode"`
+	// Audiences are accepted audiences of bearer tokens, at least one of them must be
+	// present in the aud claim, or be the client_id of introspected tokens. Default to
+	// the client ID.
+	Audiences []string `json:"audiences"`
+	// IntrospectionEndpoint is the token introspection endpoint, default to the
+	// introspection_endpoint in provider's discovery document.
+	IntrospectionEndpoint string `json:"introspectionEndpoint"`
+	// NegativeCacheTTL is how long an inactive token is cached in seconds, default to 60.
+	// Active tokens are cached until they expire.
+	NegativeCacheTTL int `json:"negativeCacheTTL"`
+}
+
+// Validate checks the bearer config.
+func (c BearerConfig) Validate() error {
+	switch c.Mode {
+	case BearerNone, BearerJWT, BearerIntrospection:
+		return nil
+	default:
+		return fmt.Errorf("unknown bearer token mode %q", c.Mode)
+	}
+}
+
+// bearerToken returns the token in Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(auth[7:])
+	return token, token != ""
+}
+
+// verifyBearer validates the bearer token by the configured mode. JWTs are verified
+// by the provider of its issuer, which must be the provider selected for the request
+// if any, while opaque tokens are introspected by the provider selected for the
+// request, or the default provider.
+func (s *Server) verifyBearer(r *http.Request, token string) (*identity, error) {
+	if s.bearer.Mode == BearerIntrospection {
+		p := s.selectProvider(r)
+		if p == nil {
+			p = s.defaultProvider()
+		}
+		return p.introspectBearer(r.Context(), token)
+	}
+
+	p, err := s.tokenProvider(token)
+	if err != nil {
+		return nil, err
+	}
+	if !s.providerSelected(r, p) {
+		return nil, fmt.Errorf("issuer %q is not the provider of the request", p.issuerURL)
+	}
+	return s.verifyBearerJWT(r.Context(), p, token)
+}
+
+// verifyBearerJWT verifies the JWT bearer token against provider's JWKS and
+// the accepted audiences, then extracts identity from its claims.
+func (s *Server) verifyBearerJWT(ctx context.Context, p *provider, token string) (*identity, error) {
+	verifier := p.oidc.Verifier(&oidc.Config{SkipClientIDCheck: true})
+	t, err := verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if !containsAny(t.Audience, s.bearerAudiences(p)) {
+		return nil, fmt.Errorf("unexpected audience %q", t.Audience)
+	}
+
+	var c claims
+	if err := t.Claims(&c); err != nil {
+		return nil, fmt.Errorf("parse claims: %v", err)
+	}
+
+	id, err := p.identityFromClaims(c)
+	if err != nil {
+		return nil, err
+	}
+	id.createdAt = t.IssuedAt
+	// bearer token is an access token presented by API client
+	id.accessToken = token
+	return id, nil
+}
+
+func (s *Server) bearerAudiences(p *provider) []string {
+	if len(s.bearer.Audiences) > 0 {
+		return s.bearer.Audiences
+	}
+	return []string{p.oauth2Config.ClientID}
+}
+
+func containsAny(list, elems []string) bool {
+	for _, a := range list {
+		for _, b := range elems {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
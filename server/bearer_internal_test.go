@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/fezho/oidc-auth/storage/memory"
+)
+
+func TestVerifyBearerJWT(t *testing.T) {
+	corp, partner, untrusted := newTestIdP(t), newTestIdP(t), newTestIdP(t)
+	defer corp.Close()
+	defer partner.Close()
+	defer untrusted.Close()
+
+	corpConfig := corp.config("corp")
+	corpConfig.Hosts = []string{"*.corp.com"}
+	s, err := NewServer(Config{
+		Providers: []ProviderConfig{corpConfig, partner.config("partner")},
+		Store:     memory.New(),
+		Bearer:    BearerConfig{Mode: BearerJWT, Audiences: []string{"app", "api"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the attacker key is published by none of the providers
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attacker, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: key, KeyID: "test"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := map[string]interface{}{
+		"iss":  corp.URL,
+		"aud":  "app",
+		"sub":  "u1",
+		"name": "tom",
+		"iat":  time.Now().Unix(),
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", corp.idToken(t, nil), false},
+		{"accepted audience", corp.idToken(t, map[string]interface{}{"aud": []string{"other", "api"}}), false},
+		{"wrong audience", corp.idToken(t, map[string]interface{}{"aud": "other"}), true},
+		{"no audience", corp.idToken(t, map[string]interface{}{"aud": nil}), true},
+		{"expired", corp.idToken(t, map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}), true},
+		{"bad signature", signClaims(t, attacker, forged), true},
+		{"no username", corp.idToken(t, map[string]interface{}{"name": nil}), true},
+		// tokens of other issuers are rejected, though they're signed by the same key
+		{"issuer of other provider", partner.idToken(t, nil), true},
+		{"untrusted issuer", untrusted.idToken(t, nil), true},
+		{"issuer of other provider in claims", corp.idToken(t, map[string]interface{}{"iss": partner.URL}), true},
+		{"malformed", "not.a.jwt", true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://app.corp.com/", nil)
+		id, err := s.verifyBearer(r, test.token)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.wantErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if id.username != "tom" || id.accessToken != test.token {
+			t.Errorf("%s: unexpected identity of user %q", test.name, id.username)
+		}
+	}
+}
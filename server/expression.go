@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Variables available in policy expressions written in CEL, see
+// https://github.com/google/cel-spec/blob/master/doc/langdef.md
+var expressionDeclarations = cel.Declarations(
+	// decoded ID token claims
+	decls.NewIdent("claims", decls.NewMapType(decls.String, decls.Dyn), nil),
+	decls.NewIdent("user", decls.String, nil),
+	decls.NewIdent("groups", decls.NewListType(decls.String), nil),
+	decls.NewIdent("method", decls.String, nil),
+	decls.NewIdent("host", decls.String, nil),
+	decls.NewIdent("path", decls.String, nil),
+	// request headers with lower case names, values of a header are joined by comma
+	decls.NewIdent("headers", decls.NewMapType(decls.String, decls.String), nil),
+	// time since user logged in
+	decls.NewIdent("session_age", decls.Duration, nil),
+)
+
+// compileExpression parses and type-checks a policy expression, which must evaluate to bool.
+func compileExpression(expr string) (cel.Program, error) {
+	env, err := cel.NewEnv(expressionDeclarations)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, iss := env.Compile(expr)
+	if iss != nil && iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if ast.ResultType().GetPrimitive() != exprpb.Type_BOOL {
+		return nil, fmt.Errorf("expression must evaluate to bool")
+	}
+
+	return env.Program(ast)
+}
+
+// evalExpression evaluates the compiled expression against the identity and request.
+func evalExpression(prg cel.Program, id *identity, r *http.Request) (bool, error) {
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+
+	var age time.Duration
+	if !id.createdAt.IsZero() {
+		age = time.Since(id.createdAt)
+	}
+
+	claims, err := id.claims.toMap()
+	if err != nil {
+		return false, err
+	}
+
+	val, _, err := prg.Eval(map[string]interface{}{
+		"claims":      claims,
+		"user":        id.username,
+		"groups":      id.groups,
+		"method":      r.Method,
+		"host":        r.Host,
+		"path":        cleanPath(r.URL.Path),
+		"headers":     headers,
+		"session_age": ptypes.DurationProto(age),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	result, ok := val.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression evaluated to %v, not bool", val.Value())
+	}
+	return result, nil
+}
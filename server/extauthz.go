@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+)
+
+// responseOnlyHeaders are headers of auth responses, which must not be added to
+// the upstream request on success.
+var responseOnlyHeaders = map[string]bool{
+	"Content-Type":           true,
+	"Content-Length":         true,
+	"Set-Cookie":             true,
+	"X-Content-Type-Options": true,
+}
+
+// authorizationServer implements the Envoy external authorization gRPC API,
+// https://www.envoyproxy.io/docs/envoy/latest/api-v3/service/auth/v3/external_auth.proto.
+// Checked requests are served by the server as auth requests, so that sessions,
+// OIDC redirects and headers are handled the same way as the HTTP protocol.
+type authorizationServer struct {
+	s *Server
+}
+
+// NewAuthorizationServer returns the envoy.service.auth.v3.Authorization service of the server.
+func NewAuthorizationServer(s *Server) auth.AuthorizationServer {
+	return &authorizationServer{s: s}
+}
+
+// Check authorizes the request attributes with the server.
+func (a *authorizationServer) Check(ctx context.Context, req *auth.CheckRequest) (*auth.CheckResponse, error) {
+	r, err := checkRequestToHTTP(ctx, req)
+	if err != nil {
+		return &auth.CheckResponse{
+			Status: &status.Status{Code: int32(codes.InvalidArgument), Message: err.Error()},
+		}, nil
+	}
+
+	// the request is the original one, headers of trusted proxies are not applied
+	rec := newAuthResponse()
+	a.s.handler.ServeHTTP(rec, r)
+	return checkResponse(rec), nil
+}
+
+// authResponse is the http.ResponseWriter recording the auth response of a check
+// request. Like a HTTP response, headers set after WriteHeader are not sent.
+type authResponse struct {
+	code   int
+	header http.Header
+	// sent is the header at WriteHeader
+	sent http.Header
+	body bytes.Buffer
+}
+
+func newAuthResponse() *authResponse {
+	return &authResponse{header: make(http.Header)}
+}
+
+func (a *authResponse) Header() http.Header {
+	return a.header
+}
+
+func (a *authResponse) WriteHeader(code int) {
+	if a.sent != nil {
+		return
+	}
+	a.code = code
+	a.sent = make(http.Header, len(a.header))
+	for name, values := range a.header {
+		a.sent[name] = append([]string(nil), values...)
+	}
+}
+
+func (a *authResponse) Write(b []byte) (int, error) {
+	a.WriteHeader(http.StatusOK)
+	return a.body.Write(b)
+}
+
+// result returns the status code and headers sent, the response is 200 OK if
+// nothing is written.
+func (a *authResponse) result() (int, http.Header) {
+	a.WriteHeader(http.StatusOK)
+	return a.code, a.sent
+}
+
+// checkRequestToHTTP rebuilds the original HTTP request from the attributes.
+func checkRequestToHTTP(ctx context.Context, req *auth.CheckRequest) (*http.Request, error) {
+	attrs := req.GetAttributes().GetRequest().GetHttp()
+	if attrs == nil {
+		return nil, fmt.Errorf("no http request attributes")
+	}
+
+	scheme := attrs.GetScheme()
+	if scheme == "" {
+		scheme = "http"
+	}
+	// path is the request target, including query string
+	target := attrs.GetPath()
+	if attrs.GetQuery() != "" && !strings.Contains(target, "?") {
+		target += "?" + attrs.GetQuery()
+	}
+
+	r, err := http.NewRequest(attrs.GetMethod(), scheme+"://"+attrs.GetHost()+target, strings.NewReader(attrs.GetBody()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid http request attributes: %v", err)
+	}
+	r.RequestURI = target
+	r.Host = attrs.GetHost()
+	for name, value := range attrs.GetHeaders() {
+		// pseudo headers of HTTP/2 are set in the attributes above
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		r.Header.Set(name, value)
+	}
+
+	if addr := req.GetAttributes().GetSource().GetAddress().GetSocketAddress(); addr != nil {
+		r.RemoteAddr = net.JoinHostPort(addr.GetAddress(), strconv.Itoa(int(addr.GetPortValue())))
+	}
+	return r.WithContext(ctx), nil
+}
+
+// checkResponse converts the auth response to check response, headers of a
+// successful response are added to the upstream request, while the other
+// responses are sent to user as they are, e.g. the redirect to provider.
+func checkResponse(rec *authResponse) *auth.CheckResponse {
+	statusCode, header := rec.result()
+	if statusCode == http.StatusOK {
+		var headers []*core.HeaderValueOption
+		for name, values := range header {
+			if responseOnlyHeaders[name] {
+				continue
+			}
+			headers = append(headers, headerValueOptions(name, values)...)
+		}
+		return &auth.CheckResponse{
+			Status: &status.Status{Code: int32(codes.OK)},
+			HttpResponse: &auth.CheckResponse_OkResponse{
+				OkResponse: &auth.OkHttpResponse{Headers: headers},
+			},
+		}
+	}
+
+	var headers []*core.HeaderValueOption
+	for name, values := range header {
+		headers = append(headers, headerValueOptions(name, values)...)
+	}
+
+	code := codes.PermissionDenied
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusFound {
+		code = codes.Unauthenticated
+	}
+	return &auth.CheckResponse{
+		Status: &status.Status{Code: int32(code)},
+		HttpResponse: &auth.CheckResponse_DeniedResponse{
+			DeniedResponse: &auth.DeniedHttpResponse{
+				Status:  &envoytype.HttpStatus{Code: envoytype.StatusCode(statusCode)},
+				Headers: headers,
+				Body:    rec.body.String(),
+			},
+		},
+	}
+}
+
+// headerValueOptions overwrites the header with the first value, and appends the others.
+func headerValueOptions(name string, values []string) []*core.HeaderValueOption {
+	options := make([]*core.HeaderValueOption, 0, len(values))
+	for i, value := range values {
+		options = append(options, &core.HeaderValueOption{
+			Header: &core.HeaderValue{Key: name, Value: value},
+			Append: &wrappers.BoolValue{Value: i > 0},
+		})
+	}
+	return options
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc/codes"
+)
+
+func TestCheckSkipsTrustedProxies(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Url", r.URL.String())
+		w.WriteHeader(http.StatusOK)
+	})
+	proxies, err := newTrustedProxies(TrustedProxyConfig{Preset: "traefik", CIDRs: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{mux: proxies.handler(handler), handler: handler}
+
+	// user in a trusted network spoofs the forwarded headers
+	req := &auth.CheckRequest{Attributes: &auth.AttributeContext{
+		Source: &auth.AttributeContext_Peer{Address: &core.Address{Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{Address: "10.0.0.1", PortSpecifier: &core.SocketAddress_PortValue{PortValue: 1234}},
+		}}},
+		Request: &auth.AttributeContext_Request{Http: &auth.AttributeContext_HttpRequest{
+			Method: "GET",
+			Scheme: "https",
+			Host:   "app.com",
+			Path:   "/admin",
+			Headers: map[string]string{
+				"x-forwarded-host": "public.com",
+				"x-forwarded-uri":  "/public",
+			},
+		}},
+	}}
+	resp, err := NewAuthorizationServer(s).Check(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for _, h := range resp.GetOkResponse().GetHeaders() {
+		if h.GetHeader().GetKey() == "X-Url" {
+			got = h.GetHeader().GetValue()
+		}
+	}
+	if want := "https://app.com/admin"; got != want {
+		t.Errorf("expected checked URL %q, got %q", want, got)
+	}
+}
+
+func TestCheckRequestToHTTP(t *testing.T) {
+	source := &auth.AttributeContext_Peer{Address: &core.Address{Address: &core.Address_SocketAddress{
+		SocketAddress: &core.SocketAddress{Address: "192.168.1.2", PortSpecifier: &core.SocketAddress_PortValue{PortValue: 5678}},
+	}}}
+	tests := []struct {
+		name       string
+		attrs      *auth.AttributeContext_HttpRequest
+		source     *auth.AttributeContext_Peer
+		wantErr    bool
+		wantURL    string
+		wantURI    string
+		wantRemote string
+	}{
+		{
+			name:    "no http attributes",
+			wantErr: true,
+		},
+		{
+			name:       "path with query",
+			attrs:      &auth.AttributeContext_HttpRequest{Method: "GET", Scheme: "https", Host: "app.com", Path: "/a?b=c"},
+			source:     source,
+			wantURL:    "https://app.com/a?b=c",
+			wantURI:    "/a?b=c",
+			wantRemote: "192.168.1.2:5678",
+		},
+		{
+			name:    "separate query",
+			attrs:   &auth.AttributeContext_HttpRequest{Method: "GET", Host: "app.com", Path: "/a", Query: "b=c"},
+			wantURL: "http://app.com/a?b=c",
+			wantURI: "/a?b=c",
+		},
+		{
+			name:    "invalid method",
+			attrs:   &auth.AttributeContext_HttpRequest{Method: "GE T", Host: "app.com", Path: "/"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		req := &auth.CheckRequest{Attributes: &auth.AttributeContext{
+			Source:  test.source,
+			Request: &auth.AttributeContext_Request{Http: test.attrs},
+		}}
+		r, err := checkRequestToHTTP(context.Background(), req)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := r.URL.String(); got != test.wantURL {
+			t.Errorf("%s: expected URL %q, got %q", test.name, test.wantURL, got)
+		}
+		if r.RequestURI != test.wantURI {
+			t.Errorf("%s: expected request URI %q, got %q", test.name, test.wantURI, r.RequestURI)
+		}
+		if r.RemoteAddr != test.wantRemote {
+			t.Errorf("%s: expected remote address %q, got %q", test.name, test.wantRemote, r.RemoteAddr)
+		}
+	}
+
+	// pseudo headers are skipped
+	req := &auth.CheckRequest{Attributes: &auth.AttributeContext{Request: &auth.AttributeContext_Request{
+		Http: &auth.AttributeContext_HttpRequest{
+			Method:  "POST",
+			Host:    "app.com",
+			Path:    "/",
+			Headers: map[string]string{":authority": "app.com", "cookie": "a=b", "accept": "application/json"},
+		},
+	}}}
+	r, err := checkRequestToHTTP(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Header) != 2 || r.Header.Get("Cookie") != "a=b" || r.Header.Get("Accept") != "application/json" {
+		t.Errorf("expected cookie and accept headers, got %v", r.Header)
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        int
+		headers     map[string][]string
+		body        string
+		wantCode    codes.Code
+		wantHeaders map[string][]bool
+	}{
+		{
+			name:     "ok",
+			code:     http.StatusOK,
+			headers:  map[string][]string{"User_name": {"tom"}, "Set-Cookie": {"a=b"}, "X-Groups": {"a", "b"}},
+			wantCode: codes.OK,
+			// values of a header are appended except the first one
+			wantHeaders: map[string][]bool{"User_name": {false}, "X-Groups": {false, true}},
+		},
+		{
+			name:        "redirect to provider",
+			code:        http.StatusFound,
+			headers:     map[string][]string{"Location": {"https://idp.com/auth"}, "Set-Cookie": {"a=b"}},
+			wantCode:    codes.Unauthenticated,
+			wantHeaders: map[string][]bool{"Location": {false}, "Set-Cookie": {false}},
+		},
+		{
+			name:     "unauthorized",
+			code:     http.StatusUnauthorized,
+			body:     "unauthenticated",
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "forbidden",
+			code:     http.StatusForbidden,
+			body:     "access is forbidden",
+			wantCode: codes.PermissionDenied,
+		},
+	}
+	for _, test := range tests {
+		rec := newAuthResponse()
+		for name, values := range test.headers {
+			rec.Header()[name] = values
+		}
+		rec.WriteHeader(test.code)
+		rec.Write([]byte(test.body)) // nolint
+
+		resp := checkResponse(rec)
+		if got := codes.Code(resp.GetStatus().GetCode()); got != test.wantCode {
+			t.Errorf("%s: expected code %s, got %s", test.name, test.wantCode, got)
+		}
+
+		options := resp.GetOkResponse().GetHeaders()
+		if test.code != http.StatusOK {
+			denied := resp.GetDeniedResponse()
+			if got := int(denied.GetStatus().GetCode()); got != test.code {
+				t.Errorf("%s: expected status %d, got %d", test.name, test.code, got)
+			}
+			if denied.GetBody() != test.body {
+				t.Errorf("%s: expected body %q, got %q", test.name, test.body, denied.GetBody())
+			}
+			options = denied.GetHeaders()
+		}
+		got := make(map[string][]bool)
+		for _, option := range options {
+			// headers of the recorder itself are not checked
+			if name := option.GetHeader().GetKey(); name != "Content-Type" && name != "X-Content-Type-Options" {
+				got[name] = append(got[name], option.GetAppend().GetValue())
+			}
+		}
+		if len(got) != 0 || len(test.wantHeaders) != 0 {
+			if !reflect.DeepEqual(got, test.wantHeaders) {
+				t.Errorf("%s: expected headers %v, got %v", test.name, test.wantHeaders, got)
+			}
+		}
+	}
+}
+
+func TestAuthResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		write    func(w http.ResponseWriter)
+		wantCode int
+		wantUser string
+		wantBody string
+	}{
+		{"nothing written", func(w http.ResponseWriter) { w.Header().Set("User_name", "tom") }, http.StatusOK, "tom", ""},
+		{"body written", func(w http.ResponseWriter) {
+			w.Header().Set("User_name", "tom")
+			w.Write([]byte("ok")) // nolint
+		}, http.StatusOK, "tom", "ok"},
+		{"status written", func(w http.ResponseWriter) {
+			http.Error(w, "access is forbidden", http.StatusForbidden)
+		}, http.StatusForbidden, "", "access is forbidden\n"},
+		// headers and status after WriteHeader are not sent
+		{"header after status", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Header().Set("User_name", "tom")
+			w.WriteHeader(http.StatusOK)
+		}, http.StatusUnauthorized, "", ""},
+	}
+	for _, test := range tests {
+		rec := newAuthResponse()
+		test.write(rec)
+		code, header := rec.result()
+		if code != test.wantCode {
+			t.Errorf("%s: expected code %d, got %d", test.name, test.wantCode, code)
+		}
+		if got := header.Get("User_name"); got != test.wantUser {
+			t.Errorf("%s: expected user %q, got %q", test.name, test.wantUser, got)
+		}
+		if got := rec.body.String(); got != test.wantBody {
+			t.Errorf("%s: expected body %q, got %q", test.name, test.wantBody, got)
+		}
+	}
+}
@@ -1,8 +1,9 @@
 package server
 
 import (
-	"context"
 	"net/http"
+	"net/url"
+	"path"
 	"strings"
 	"time"
 
@@ -13,8 +14,6 @@ import (
 	"golang.org/x/oauth2"
 )
 
-const authSessionName = "oidc-auth.session"
-
 // TODO: support implicit flow like https://github.com/argoproj/argo-cd/blob/master/util/oidc/oidc.go
 
 // callback is the handler responsible for exchanging the auth_code and retrieving an id_token.
@@ -32,24 +31,44 @@ func (s *Server) callback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, err := s.store.Get(r, authSessionName)
+	// Verify state, there must be a login transaction started with it
+	txnSession, err := s.loginSession(r, state)
 	if err != nil {
-		log.Errorf("server: get session: %s", err)
+		log.Errorf("server: get login session: %s", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	txn, ok := loginTransactionOf(txnSession)
+	// login transaction can only be used once
+	if !txnSession.IsNew {
+		deleteCookie(txnSession, w, r)
+	}
+	if !ok {
+		http.Error(w, "access is unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	// Verify state
-	if nonce := session.Flashes("nonce"); len(nonce) == 0 || nonce[0].(string) != state {
-		deleteCookie(session, w, r)
+	redirect, nonce, verifier := txn.redirectTo, txn.nonce, txn.codeVerifier
+	p := s.providerByName(txn.provider)
+	if p == nil || p.callbackPath != r.URL.Path || nonce == "" || (p.pkce && verifier == "") {
 		http.Error(w, "access is unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	redirect := session.Flashes("redirect_to")
+	var exchangeOpts []oauth2.AuthCodeOption
+	if p.pkce {
+		exchangeOpts = append(exchangeOpts, codeVerifierOption(verifier))
+	}
+
+	session, err := s.authSession(r)
+	if err != nil {
+		log.Errorf("server: get session: %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
 
 	// Exchange the authorization code with {access, refresh, id}_token
-	oauth2Token, err := s.oauth2Config.Exchange(r.Context(), authCode)
+	oauth2Token, err := p.oauth2Config.Exchange(r.Context(), authCode, exchangeOpts...)
 	if err != nil {
 		log.Errorf("failed to exchange auth code, %v", err)
 		deleteCookie(session, w, r)
@@ -57,9 +76,12 @@ func (s *Server) callback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if s.offlineAccess {
+	if p.offlineAccess {
 		session.Values["refresh-token"] = oauth2Token.RefreshToken
 	}
+	if p.storeAccessToken {
+		session.Values["access_token"] = oauth2Token.AccessToken
+	}
 
 	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
 	if !ok {
@@ -69,86 +91,164 @@ func (s *Server) callback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if valid := s.authenticateToken(rawIDToken, session, w, r); !valid {
+	if valid := s.authenticateToken(p, rawIDToken, oauth2Token.AccessToken, nonce, session, w, r); !valid {
 		//deleteCookie(session, w, r)
 		return
 	}
 
 	log.Debug("Login validated with ID token, redirecting.")
 
-	if len(redirect) > 0 {
-		http.Redirect(w, r, redirect[0].(string), http.StatusSeeOther)
-	}
+	http.Redirect(w, r, s.redirects.target(r, redirect), http.StatusSeeOther)
 }
 
 // refreshToken refreshes the token in session
 func (s *Server) refreshToken(w http.ResponseWriter, r *http.Request) {
-	session, err := s.store.Get(r, authSessionName)
+	session, err := s.authSession(r)
 	if err != nil {
 		log.Error(err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 	if session.IsNew {
-		log.Error(err)
-		http.Error(w, "authentication failed", http.StatusUnauthorized)
-		return
-	}
-	refresh, ok := session.Values["refresh-token"].(string)
-	if !ok {
-		log.Error(err)
 		http.Error(w, "authentication failed", http.StatusUnauthorized)
 		return
 	}
-	t := &oauth2.Token{
-		RefreshToken: refresh,
-		Expiry:       time.Now().Add(-time.Hour),
+
+	p, err := s.sessionProvider(session)
+	if err == nil {
+		err = s.refreshSession(r, p, session)
 	}
-	oauth2Token, err := s.oauth2Config.TokenSource(context.Background(), t).Token()
 	if err != nil {
-		log.Error(err)
-		http.Error(w, "authentication failed", http.StatusUnauthorized)
-		return
-	}
-	session.Values["refresh-token"] = oauth2Token.RefreshToken
-	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
-	if !ok {
-		log.Error(err)
+		log.Errorf("server: refresh session: %s", err)
 		http.Error(w, "authentication failed", http.StatusUnauthorized)
 		return
 	}
 
-	s.authenticateToken(rawIDToken, session, w, r)
+	if err := s.saveSession(session, w, r); err != nil {
+		log.Errorf("server: save session: %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
 }
 
 // logout is the handler responsible for revoking the user's session.
 func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
 	// Revoke user session
-	session, err := s.store.Get(r, authSessionName)
+	session, err := s.authSession(r)
 	if err != nil {
 		log.Error(err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
+	// ID token of a session which doesn't belong to the server is not sent as hint
+	p := s.defaultProvider()
+	var idToken string
+	if !session.IsNew {
+		if sp, err := s.sessionProvider(session); err != nil {
+			log.Warnf("server: logout: %s", err)
+		} else {
+			p = sp
+			idToken, _ = session.Values["id_token"].(string)
+		}
+	}
+
+	// Redirect target after logout must be one of the post-logout URIs registered at provider,
+	// or an allowed redirect if there's no end_session_endpoint. Default to the first URI.
+	redirect := r.URL.Query().Get("redirect")
+	if redirect != "" && !p.allowedPostLogoutRedirect(redirect) {
+		if p.endSessionEndpoint == "" {
+			redirect = s.redirects.target(r, redirect)
+		} else {
+			log.Warnf("server: reject post-logout redirect to %q", redirect)
+			redirect = ""
+		}
+	}
+	if redirect == "" && len(p.postLogoutRedirectURIs) > 0 {
+		redirect = p.postLogoutRedirectURIs[0]
+	}
+
 	if !session.IsNew {
 		deleteCookie(session, w, r)
 	}
 
+	// RP-initiated logout, end user's session at provider too
+	if p.endSessionEndpoint != "" {
+		http.Redirect(w, r, p.endSessionURL(idToken, redirect), http.StatusFound)
+		return
+	}
+
+	if redirect != "" {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Logout successfully.")) // nolint
 }
 
+func (p *provider) allowedPostLogoutRedirect(uri string) bool {
+	for _, allowed := range p.postLogoutRedirectURIs {
+		if uri == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// endSessionURL builds the URL of provider's end_session_endpoint, see
+// https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+func (p *provider) endSessionURL(idToken, postLogoutRedirectURI string) string {
+	params := url.Values{}
+	if idToken != "" {
+		params.Set("id_token_hint", idToken)
+	} else {
+		params.Set("client_id", p.oauth2Config.ClientID)
+	}
+	if postLogoutRedirectURI != "" {
+		params.Set("post_logout_redirect_uri", postLogoutRedirectURI)
+	}
+
+	sep := "?"
+	if strings.Contains(p.endSessionEndpoint, "?") {
+		sep = "&"
+	}
+	return p.endSessionEndpoint + sep + params.Encode()
+}
+
 func deleteCookie(session *sessions.Session, w http.ResponseWriter, r *http.Request) {
 	session.Options.MaxAge = -1
 	_ = session.Save(r, w) // return nil
 }
 
 func (s *Server) auth(w http.ResponseWriter, r *http.Request) {
-	// TODO: add whitelist check
+	// Access rules are checked before session lookup
+	rule := s.rules.match(r)
+	if rule != nil {
+		switch rule.Action {
+		case ActionPublic:
+			w.WriteHeader(http.StatusOK)
+			return
+		case ActionDeny:
+			http.Error(w, "access is forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	// API clients present tokens issued by IdP instead of session cookie
+	if token, ok := bearerToken(r); ok && s.bearer.Mode != BearerNone {
+		id, err := s.verifyBearer(r, token)
+		if err != nil {
+			log.Infof("server: verify bearer token: %s", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		s.login(rule, id, w, r)
+		return
+	}
 
 	// Check if user session is valid
-	session, err := s.store.Get(r, authSessionName)
+	session, err := s.authSession(r)
 	if err != nil {
 		log.Errorf("server: get session: %s", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
@@ -158,30 +258,106 @@ func (s *Server) auth(w http.ResponseWriter, r *http.Request) {
 	// User is logged in
 	if !session.IsNew {
 		if _, ok := session.Values["user_name"]; ok {
-			s.login(session, w)
+			p, err := s.sessionProvider(session)
+			refreshed := false
+			if err == nil {
+				refreshed, err = s.ensureFresh(r, p, session)
+			}
+			if err != nil {
+				log.Infof("server: end session: %s", err)
+				deleteCookie(session, w, r)
+				s.doOIDCAuth(w, r, true)
+				return
+			}
+			// user logged in with another provider than the one the request is assigned to,
+			// consent isn't prompted again, or users switching apps are prompted each time
+			if !s.providerSelected(r, p) {
+				s.doOIDCAuth(w, r, false)
+				return
+			}
+			if refreshed {
+				if err := s.saveSession(session, w, r); err != nil {
+					log.Errorf("server: save session: %s", err)
+					http.Error(w, "internal error", http.StatusInternalServerError)
+					return
+				}
+			}
+			s.login(rule, identityFromSession(session), w, r)
 			return
 		}
 		log.Debugf("session is expired, %v", session)
-		// remove redirect_to & nonce first to make sure they are latest
-		session.Flashes("redirect_to")
-		session.Flashes("nonce")
 	}
 
 	// User is NOT logged in
-	s.doOIDCAuth(session, w, r)
+	s.doOIDCAuth(w, r, true)
 }
 
-func (s *Server) doOIDCAuth(session *sessions.Session, w http.ResponseWriter, r *http.Request) {
+// doOIDCAuth starts login with the provider selected for the request, or redirects
+// user to the login chooser if no provider is selected. API requests are answered
+// with 401 instead, since they can't follow the redirects. User is prompted for
+// consent if forceApproval is true.
+func (s *Server) doOIDCAuth(w http.ResponseWriter, r *http.Request, forceApproval bool) {
+	if s.api.isAPIRequest(r) {
+		s.unauthenticated(w, r)
+		return
+	}
+	p := s.selectProvider(r)
+	if p == nil {
+		chooser := url.URL{
+			Path:     path.Join(s.rootPath, "login"),
+			RawQuery: url.Values{"rd": {r.URL.String()}}.Encode(),
+		}
+		http.Redirect(w, r, chooser.String(), http.StatusFound)
+		return
+	}
+	s.startLogin(p, r.URL.String(), forceApproval, w, r)
+}
+
+// startLogin redirects user to the provider's authorization endpoint, user will be
+// redirected back to redirectTo after login.
+func (s *Server) startLogin(p *provider, redirectTo string, forceApproval bool, w http.ResponseWriter, r *http.Request) {
+	// state protects the redirect against CSRF, while nonce binds the ID token
+	// to this login attempt and prevents it from being replayed.
+	state := uuid.New().String()
 	nonce := uuid.New().String()
-	session.AddFlash(r.URL.String(), "redirect_to")
-	session.AddFlash(nonce, "nonce")
+
+	session, err := s.loginSession(r, state)
+	if err != nil {
+		log.Errorf("server: get login session: %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	txn := loginTransaction{
+		provider:   p.name,
+		redirectTo: redirectTo,
+		nonce:      nonce,
+		createdAt:  time.Now().Unix(),
+	}
+
+	opts := []oauth2.AuthCodeOption{oidc.Nonce(nonce)}
+	if forceApproval {
+		opts = append(opts, oauth2.ApprovalForce)
+	}
+	if p.pkce {
+		verifier, err := newCodeVerifier()
+		if err != nil {
+			log.Errorf("server: %s", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		txn.codeVerifier = verifier
+		opts = append(opts, codeChallengeOptions(verifier)...)
+	}
+
+	setLoginTransaction(session, txn)
+	dropLoginSessions(w, r)
 	if err := session.Save(r, w); err != nil {
 		log.Errorf("server: save session: %s", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	authCodeURL := s.oauth2Config.AuthCodeURL(nonce, oauth2.ApprovalForce)
+	authCodeURL := p.oauth2Config.AuthCodeURL(state, opts...)
 
 	// check the connector_id in request parameters
 	connectorID := r.URL.Query().Get("connector_id")
@@ -192,40 +368,27 @@ func (s *Server) doOIDCAuth(session *sessions.Session, w http.ResponseWriter, r
 	http.Redirect(w, r, authCodeURL, http.StatusFound)
 }
 
-// authenticateToken verifies received ID token, extracts claims, save session
-func (s *Server) authenticateToken(token string, session *sessions.Session, w http.ResponseWriter, r *http.Request) bool {
-	verifier := s.provider.Verifier(&oidc.Config{ClientID: s.oauth2Config.ClientID})
-	idToken, err := verifier.Verify(r.Context(), token)
-	if err != nil {
-		log.Errorf("server: verify token: %s", err)
-		http.Error(w, "authentication failed", http.StatusUnauthorized)
-		return false
-	}
-
-	var c claims
-	if err := idToken.Claims(&c); err != nil {
-		log.Errorf("server: parse oidc claims: %s", err)
+// authenticateToken verifies received ID token, extracts claims, save session.
+// The nonce claim of the ID token must match the given nonce unless it's empty.
+func (s *Server) authenticateToken(p *provider, token, accessToken, nonce string, session *sessions.Session, w http.ResponseWriter, r *http.Request) bool {
+	if err := p.updateSession(r.Context(), token, accessToken, nonce, session); err != nil {
+		log.Errorf("server: authenticate token: %s", err)
 		http.Error(w, "authentication failed", http.StatusUnauthorized)
 		return false
 	}
 
-	username, err := c.extractUsername(s.usernameClaim)
-	if err != nil {
-		log.Errorf("server: extract user name: %s", err)
-		http.Error(w, "authentication failed", http.StatusUnauthorized)
-	}
-	session.Values["user_name"] = username
-	if len(s.groupsClaim) > 0 {
-		groups, err := c.extractGroups(s.groupsClaim)
-		if err != nil {
-			log.Errorf("server: extract user group: %s", err)
-			http.Error(w, "authentication failed", http.StatusUnauthorized)
+	if err := s.limitSessions(session); err != nil {
+		if err == errTooManySessions {
+			log.Infof("server: refuse login of %v: %s", session.Values["user_name"], err)
+			http.Error(w, "too many sessions, logout on other devices first", http.StatusForbidden)
+			return false
 		}
-		session.Values["user_groups"] = groups
+		log.Errorf("server: limit sessions: %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
 	}
 
-	session.Values["id_token"] = token
-	if err := session.Save(r, w); err != nil {
+	if err := s.saveSession(session, w, r); err != nil {
 		log.Errorf("server: save session: %s", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return false
@@ -233,18 +396,37 @@ func (s *Server) authenticateToken(token string, session *sessions.Session, w ht
 	return true
 }
 
-// login sets user info into response header
-func (s *Server) login(session *sessions.Session, w http.ResponseWriter) {
-	// : maybe this code should be optimized
-	user, ok := session.Values["user_name"].(string)
-	if ok {
-		w.Header().Set("user_name", user)
-	}
-	if len(s.groupsClaim) > 0 {
-		groups, ok := session.Values["user_groups"].(string)
-		if ok {
-			w.Header().Set("user_groups", groups)
+// login authorizes the user by the matched rule, and sets user info into response header
+func (s *Server) login(rule *rule, id *identity, w http.ResponseWriter, r *http.Request) {
+	if rule != nil {
+		if err := rule.authorize(id, r); err != nil {
+			log.Infof("server: access denied: %s", err)
+			http.Error(w, "access is forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	w.Header().Set("user_name", id.username)
+	if len(id.groups) > 0 {
+		w.Header().Set("user_groups", strings.Join(id.groups, ","))
+	}
+	if len(id.scopes) > 0 {
+		w.Header().Set("user_scopes", strings.Join(id.scopes, " "))
+	}
+	for name, value := range id.headers {
+		w.Header().Set(name, value)
+	}
+	if rule != nil {
+		forwardToken(rule.ForwardToken, id, w)
+	}
+	if s.asserter != nil {
+		assertion, err := s.asserter.mint(id)
+		if err != nil {
+			log.Errorf("server: mint assertion: %s", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
 		}
+		w.Header().Set(s.asserter.header, assertion)
 	}
 
 	log.Debug("login succeed")
@@ -252,7 +434,25 @@ func (s *Server) login(session *sessions.Session, w http.ResponseWriter) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func bearerTokenHandler(next http.HandlerFunc) http.HandlerFunc {
+// forwardToken sets the token of user in response header, so that it reaches upstream.
+func forwardToken(token ForwardToken, id *identity, w http.ResponseWriter) {
+	switch token {
+	case ForwardAccessToken:
+		if id.accessToken == "" {
+			log.Warnf("server: no access token of user %q to forward", id.username)
+			return
+		}
+		w.Header().Set("Authorization", "Bearer "+id.accessToken)
+	case ForwardIDToken:
+		if id.idToken == "" {
+			log.Warnf("server: no ID token of user %q to forward", id.username)
+			return
+		}
+		w.Header().Set("X-Id-Token", id.idToken)
+	}
+}
+
+func bearerTokenHandler(sessionName string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Call the next handler in the chain.
 		auth := r.Header.Get("Authorization")
@@ -263,7 +463,7 @@ func bearerTokenHandler(next http.HandlerFunc) http.HandlerFunc {
 			}
 			bearerToken := strings.TrimPrefix(auth, "Bearer ")
 			r.AddCookie(&http.Cookie{
-				Name:  authSessionName,
+				Name:  sessionName,
 				Value: bearerToken,
 			})
 		}
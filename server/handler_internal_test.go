@@ -0,0 +1,316 @@
+package server
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/fezho/oidc-auth/storage/memory"
+)
+
+func TestAuthBearerOfOtherProvider(t *testing.T) {
+	corp, partner := newTestIdP(t), newTestIdP(t)
+	defer corp.Close()
+	defer partner.Close()
+
+	corpConfig := corp.config("corp")
+	corpConfig.Hosts = []string{"*.corp.com"}
+	s, err := NewServer(Config{
+		Providers: []ProviderConfig{corpConfig, partner.config("partner")},
+		Store:     memory.New(),
+		Bearer:    BearerConfig{Mode: BearerJWT},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		token    string
+		wantCode int
+	}{
+		{"selected provider", "http://app.corp.com/", corp.idToken(t, nil), http.StatusOK},
+		{"other provider", "http://app.corp.com/", partner.idToken(t, nil), http.StatusUnauthorized},
+		{"no provider selected", "http://app.com/", partner.idToken(t, nil), http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.url, nil)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.wantCode {
+			t.Errorf("%s: expected code %d, got %d", test.name, test.wantCode, w.Code)
+			continue
+		}
+		if test.wantCode == http.StatusUnauthorized {
+			if got := w.Header().Get("WWW-Authenticate"); got != `Bearer error="invalid_token"` {
+				t.Errorf("%s: unexpected WWW-Authenticate %q", test.name, got)
+			}
+			if loc := w.Header().Get("Location"); loc != "" {
+				t.Errorf("%s: unexpected login redirect to %q", test.name, loc)
+			}
+		}
+	}
+}
+
+func TestCallbackNonce(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	s, err := NewServer(Config{Providers: []ProviderConfig{idp.config("")}, Store: memory.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// nonce returns the nonce claim of ID token by the nonce of login
+		nonce    func(nonce string) interface{}
+		wantCode int
+	}{
+		{"matching nonce", func(nonce string) interface{} { return nonce }, http.StatusSeeOther},
+		{"wrong nonce", func(nonce string) interface{} { return nonce + "x" }, http.StatusUnauthorized},
+		{"no nonce", func(nonce string) interface{} { return nil }, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// authorization code is the nonce of the login in this test
+			idp.token = func(form url.Values) interface{} {
+				return map[string]interface{}{
+					"access_token": "at",
+					"token_type":   "Bearer",
+					"id_token":     idp.idToken(t, map[string]interface{}{"nonce": test.nonce(form.Get("code"))}),
+				}
+			}
+			jar, err := cookiejar.New(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			query := startTestLogin(t, s, jar, jarRequest(jar, "http://app.com/"))
+			callback := "http://app.com/oidc/callback?" + url.Values{"code": {query.Get("nonce")}, "state": {query.Get("state")}}.Encode()
+			if w := serveWithJar(s, jar, jarRequest(jar, callback)); w.Code != test.wantCode {
+				t.Fatalf("expected code %d, got %d", test.wantCode, w.Code)
+			}
+
+			// user is logged in only if the ID token is bound to the login
+			w := serveWithJar(s, jar, jarRequest(jar, "http://app.com/"))
+			if loggedIn := w.Code == http.StatusOK; loggedIn != (test.wantCode == http.StatusSeeOther) {
+				t.Errorf("unexpected auth code %d after login", w.Code)
+			}
+		})
+	}
+}
+
+func TestLoginConsent(t *testing.T) {
+	corp, partner := newTestIdP(t), newTestIdP(t)
+	defer corp.Close()
+	defer partner.Close()
+
+	corpConfig := corp.config("corp")
+	corpConfig.Hosts = []string{"*.corp.com"}
+	s, err := NewServer(Config{
+		Providers: []ProviderConfig{corpConfig, partner.config("partner")},
+		Store:     memory.New(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loggedIn, _ := loggedInSession(t, s, s.providerByName("partner"), time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name        string
+		cookies     []*http.Cookie
+		wantConsent bool
+	}{
+		{"not logged in", nil, true},
+		// user logged in with partner is switched to corp without prompting consent
+		{"provider switch", loggedIn.Cookies(), false},
+	}
+	for _, test := range tests {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://app.corp.com/", nil)
+		for _, c := range test.cookies {
+			r.AddCookie(c)
+		}
+		query := startTestLogin(t, s, jar, r)
+		if got := query.Get("prompt") == "consent"; got != test.wantConsent {
+			t.Errorf("%s: expected consent prompted %v, got %v", test.name, test.wantConsent, got)
+		}
+	}
+}
+
+func TestEndSessionURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		idToken  string
+		redirect string
+		want     string
+	}{
+		{"id token hint", "https://idp.com/logout", "idt", "", "https://idp.com/logout?id_token_hint=idt"},
+		{"client id without id token", "https://idp.com/logout", "", "", "https://idp.com/logout?client_id=app"},
+		{
+			"post logout redirect", "https://idp.com/logout", "idt", "https://app.com/bye?a=b",
+			"https://idp.com/logout?id_token_hint=idt&post_logout_redirect_uri=https%3A%2F%2Fapp.com%2Fbye%3Fa%3Db",
+		},
+		{"endpoint with query", "https://idp.com/logout?tenant=t", "idt", "", "https://idp.com/logout?tenant=t&id_token_hint=idt"},
+	}
+	for _, test := range tests {
+		p := &provider{endSessionEndpoint: test.endpoint, oauth2Config: &oauth2.Config{ClientID: "app"}}
+		if got := p.endSessionURL(test.idToken, test.redirect); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestLogout(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	endSession := idp.URL + "/logout"
+
+	tests := []struct {
+		name string
+		// endSession is whether the provider supports RP-initiated logout
+		endSession     bool
+		postLogoutURIs []string
+		loggedIn       bool
+		redirect       string
+		// wantLocation is empty if logout isn't redirected
+		wantLocation string
+	}{
+		{
+			name: "end session", endSession: true, postLogoutURIs: []string{"https://app.com/bye"}, loggedIn: true,
+			wantLocation: endSession + "?" + url.Values{"id_token_hint": {"idt"}, "post_logout_redirect_uri": {"https://app.com/bye"}}.Encode(),
+		},
+		{
+			name: "end session of registered redirect", endSession: true, postLogoutURIs: []string{"https://app.com/bye", "https://app.com/later"},
+			loggedIn: true, redirect: "https://app.com/later",
+			wantLocation: endSession + "?" + url.Values{"id_token_hint": {"idt"}, "post_logout_redirect_uri": {"https://app.com/later"}}.Encode(),
+		},
+		{
+			// redirects allowed by the redirect policy aren't registered at provider
+			name: "end session of unregistered redirect", endSession: true, postLogoutURIs: []string{"https://app.com/bye"},
+			loggedIn: true, redirect: "https://www.app.com/",
+			wantLocation: endSession + "?" + url.Values{"id_token_hint": {"idt"}, "post_logout_redirect_uri": {"https://app.com/bye"}}.Encode(),
+		},
+		{
+			name: "end session without redirect", endSession: true, loggedIn: true,
+			wantLocation: endSession + "?" + url.Values{"id_token_hint": {"idt"}}.Encode(),
+		},
+		{
+			name: "end session without login", endSession: true, postLogoutURIs: []string{"https://app.com/bye"},
+			wantLocation: endSession + "?" + url.Values{"client_id": {"app"}, "post_logout_redirect_uri": {"https://app.com/bye"}}.Encode(),
+		},
+		// without end_session_endpoint, user is redirected by the redirect policy
+		{name: "allowed redirect", postLogoutURIs: []string{"https://app.com/bye"}, loggedIn: true, redirect: "https://www.app.com/", wantLocation: "https://www.app.com/"},
+		{name: "registered redirect", postLogoutURIs: []string{"https://app.com/bye"}, loggedIn: true, redirect: "https://app.com/bye", wantLocation: "https://app.com/bye"},
+		{name: "disallowed redirect", loggedIn: true, redirect: "https://evil.com/", wantLocation: "/home"},
+		{name: "default redirect", postLogoutURIs: []string{"https://app.com/bye"}, loggedIn: true, wantLocation: "https://app.com/bye"},
+		{name: "no redirect", loggedIn: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delete(idp.metadata, "end_session_endpoint")
+			if test.endSession {
+				idp.metadata["end_session_endpoint"] = endSession
+			}
+			config := idp.config("")
+			config.PostLogoutRedirectURIs = test.postLogoutURIs
+			s, err := NewServer(Config{
+				Providers: []ProviderConfig{config},
+				Store:     memory.New(),
+				Redirect:  RedirectConfig{AllowedHosts: []string{"*.app.com"}, DefaultURL: "/home"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target := "http://app.com/oidc/logout"
+			if test.redirect != "" {
+				target += "?" + url.Values{"redirect": {test.redirect}}.Encode()
+			}
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			if test.loggedIn {
+				loggedIn, session := loggedInSession(t, s, s.defaultProvider(), time.Now().Add(time.Hour))
+				session.Values["id_token"] = "idt"
+				if err := session.Save(loggedIn, httptest.NewRecorder()); err != nil {
+					t.Fatal(err)
+				}
+				for _, c := range loggedIn.Cookies() {
+					r.AddCookie(c)
+				}
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+
+			if test.wantLocation == "" {
+				if w.Code != http.StatusOK {
+					t.Errorf("expected code 200, got %d", w.Code)
+				}
+			} else if w.Code != http.StatusFound || w.Header().Get("Location") != test.wantLocation {
+				t.Errorf("expected redirect to %q, got code %d to %q", test.wantLocation, w.Code, w.Header().Get("Location"))
+			}
+
+			deleted := false
+			for _, c := range w.Result().Cookies() {
+				if c.Name == defaultSessionName && c.MaxAge < 0 {
+					deleted = true
+				}
+			}
+			if deleted != test.loggedIn {
+				t.Errorf("expected session cookie deleted %v, got %v", test.loggedIn, deleted)
+			}
+		})
+	}
+}
+
+func TestForwardToken(t *testing.T) {
+	tom := &identity{username: "tom", accessToken: "at", idToken: "idt"}
+	tests := []struct {
+		name      string
+		token     ForwardToken
+		id        *identity
+		noRule    bool
+		wantAuth  string
+		wantToken string
+	}{
+		{name: "access token", token: ForwardAccessToken, id: tom, wantAuth: "Bearer at"},
+		{name: "id token", token: ForwardIDToken, id: tom, wantToken: "idt"},
+		{name: "none", token: ForwardNone, id: tom},
+		{name: "no rule", token: ForwardAccessToken, id: tom, noRule: true},
+		{name: "no access token", token: ForwardAccessToken, id: &identity{username: "tom", idToken: "idt"}},
+		{name: "no id token", token: ForwardIDToken, id: &identity{username: "tom", accessToken: "at"}},
+	}
+	for _, test := range tests {
+		var rule *rule
+		if !test.noRule {
+			rs, err := compileRules([]Rule{{ForwardToken: test.token}})
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			rule = rs[0]
+		}
+
+		s := &Server{}
+		w := httptest.NewRecorder()
+		s.login(rule, test.id, w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected code 200, got %d", test.name, w.Code)
+		}
+		if got := w.Header().Get("Authorization"); got != test.wantAuth {
+			t.Errorf("%s: expected Authorization %q, got %q", test.name, test.wantAuth, got)
+		}
+		if got := w.Header().Get("X-Id-Token"); got != test.wantToken {
+			t.Errorf("%s: expected X-Id-Token %q, got %q", test.name, test.wantToken, got)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// headerFuncs are the helpers available in header templates besides the builtin ones.
+var headerFuncs = template.FuncMap{
+	// join concatenates the elements of a list claim by sep, e.g. {{ join "," .roles }}
+	"join": joinClaim,
+	// lower converts the value to lower case, e.g. {{ lower .email }}
+	"lower": func(v interface{}) string {
+		return strings.ToLower(claimString(v))
+	},
+	// default returns def if the claim is missing or empty, e.g. {{ .name | default "anonymous" }}
+	"default": func(def string, v interface{}) string {
+		if s := claimString(v); s != "" {
+			return s
+		}
+		return def
+	},
+}
+
+// headerTemplates are the compiled templates of response headers, keyed by header name.
+type headerTemplates map[string]*headerTemplate
+
+type headerTemplate struct {
+	*template.Template
+	// refs are the claims referenced by the template
+	refs []claimRef
+}
+
+// claimRef is a claim referenced by a header template, e.g. .nested.team
+type claimRef struct {
+	path []string
+	// optional is true if the claim is handled by default when it's absent
+	optional bool
+}
+
+// ValidateHeaders checks the header templates could be compiled.
+func ValidateHeaders(headers map[string]string) error {
+	_, err := compileHeaders(headers)
+	return err
+}
+
+func compileHeaders(headers map[string]string) (headerTemplates, error) {
+	compiled := make(headerTemplates, len(headers))
+	for name, text := range headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		tmpl, err := template.New(name).Funcs(headerFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("header %q: %v", name, err)
+		}
+		compiled[name] = &headerTemplate{Template: tmpl, refs: claimRefs(tmpl.Tree.Root, nil)}
+	}
+	return compiled, nil
+}
+
+// claimRefs collects the claims referenced by fields of the node. Claims tested by
+// if, with and range are optional, since they're false if absent. Fields within
+// range and with are not collected, since dot is not the claims there.
+func claimRefs(node parse.Node, refs []claimRef) []claimRef {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return refs
+		}
+		for _, child := range n.Nodes {
+			refs = claimRefs(child, refs)
+		}
+	case *parse.ActionNode:
+		refs = pipeClaimRefs(n.Pipe, false, refs)
+	case *parse.IfNode:
+		refs = pipeClaimRefs(n.Pipe, true, refs)
+		refs = claimRefs(n.List, refs)
+		refs = claimRefs(n.ElseList, refs)
+	case *parse.RangeNode:
+		refs = pipeClaimRefs(n.Pipe, true, refs)
+		refs = claimRefs(n.ElseList, refs)
+	case *parse.WithNode:
+		refs = pipeClaimRefs(n.Pipe, true, refs)
+		refs = claimRefs(n.ElseList, refs)
+	case *parse.TemplateNode:
+		refs = pipeClaimRefs(n.Pipe, false, refs)
+	}
+	return refs
+}
+
+// pipeClaimRefs collects the claims referenced by the pipeline, claims passed to
+// default, or piped into it, are optional.
+func pipeClaimRefs(pipe *parse.PipeNode, optional bool, refs []claimRef) []claimRef {
+	if pipe == nil {
+		return refs
+	}
+	for i, cmd := range pipe.Cmds {
+		optional := optional || isDefaultCommand(cmd) || (i+1 < len(pipe.Cmds) && isDefaultCommand(pipe.Cmds[i+1]))
+		for _, arg := range cmd.Args {
+			switch arg := arg.(type) {
+			case *parse.FieldNode:
+				refs = append(refs, claimRef{path: arg.Ident, optional: optional})
+			case *parse.PipeNode:
+				refs = pipeClaimRefs(arg, optional, refs)
+			case *parse.ChainNode:
+				if p, ok := arg.Node.(*parse.PipeNode); ok {
+					refs = pipeClaimRefs(p, optional, refs)
+				}
+			}
+		}
+	}
+	return refs
+}
+
+func isDefaultCommand(cmd *parse.CommandNode) bool {
+	if len(cmd.Args) == 0 {
+		return false
+	}
+	ident, ok := cmd.Args[0].(*parse.IdentifierNode)
+	return ok && ident.Ident == "default"
+}
+
+// execute renders the headers with the claims. Headers referencing absent claims
+// other than the ones handled by default, or rendered to empty value, are omitted.
+func (ts headerTemplates) execute(c claims) (map[string]string, error) {
+	if len(ts) == 0 {
+		return nil, nil
+	}
+
+	// numbers are decoded as json.Number to be printed as they are in token
+	data := make(map[string]interface{}, len(c))
+	for name, val := range c {
+		dec := json.NewDecoder(bytes.NewReader(val))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("oidc: parse claim %q: %v", name, err)
+		}
+		data[name] = v
+	}
+
+	// render in order of names so that errors are reproducible
+	names := make([]string, 0, len(ts))
+	for name := range ts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	headers := make(map[string]string, len(ts))
+	for _, name := range names {
+		t := ts[name]
+		tdata, ok := t.data(data)
+		if !ok {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, tdata); err != nil {
+			return nil, fmt.Errorf("render header %q: %v", name, err)
+		}
+		if value := buf.String(); value != "" {
+			headers[name] = value
+		}
+	}
+	return headers, nil
+}
+
+// data returns the claims to render the template with, absent optional claims are
+// set to nil for default. It returns false if a required claim is absent.
+func (t *headerTemplate) data(data map[string]interface{}) (map[string]interface{}, bool) {
+	for _, ref := range t.refs {
+		if hasClaimPath(data, ref.path) {
+			continue
+		}
+		if !ref.optional {
+			return nil, false
+		}
+		data = withNilClaim(data, ref.path)
+	}
+	return data, true
+}
+
+// hasClaimPath reports whether the claim of path is present and not null. Fields
+// of values other than objects are left to fail in template execution.
+func hasClaimPath(data map[string]interface{}, path []string) bool {
+	var v interface{} = data
+	for _, name := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return true
+		}
+		if v, ok = m[name]; !ok || v == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// withNilClaim returns a copy of data with the absent claim of path set to nil,
+// objects along the path are copied too.
+func withNilClaim(data map[string]interface{}, path []string) map[string]interface{} {
+	c := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		c[k] = v
+	}
+	if nested, ok := data[path[0]].(map[string]interface{}); ok && len(path) > 1 {
+		c[path[0]] = withNilClaim(nested, path[1:])
+	} else if _, ok := data[path[0]]; !ok {
+		c[path[0]] = nil
+	}
+	return c
+}
+
+func joinClaim(sep string, v interface{}) string {
+	switch v := v.(type) {
+	case []interface{}:
+		elems := make([]string, 0, len(v))
+		for _, e := range v {
+			elems = append(elems, claimString(e))
+		}
+		return strings.Join(elems, sep)
+	case []string:
+		return strings.Join(v, sep)
+	default:
+		return claimString(v)
+	}
+}
+
+// claimString formats a decoded claim value, missing claims are formatted as empty string.
+func claimString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestExecuteHeaders(t *testing.T) {
+	c := claims{
+		"email":  json.RawMessage(`"Tom@Example.com"`),
+		"roles":  json.RawMessage(`["admin","dev"]`),
+		"age":    json.RawMessage(`12345678901234567890`),
+		"name":   json.RawMessage(`""`),
+		"nested": json.RawMessage(`{"team":"core"}`),
+		"phone":  json.RawMessage(`null`),
+	}
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{name: "claim", text: "{{ .email }}", want: "Tom@Example.com"},
+		{name: "lower", text: "{{ lower .email }}", want: "tom@example.com"},
+		{name: "join", text: `{{ join "," .roles }}`, want: "admin,dev"},
+		{name: "number", text: "{{ .age }}", want: "12345678901234567890"},
+		{name: "nested", text: "{{ .nested.team }}", want: "core"},
+		// headers referencing missing claims are omitted
+		{name: "missing", text: "{{ .mobile }}"},
+		{name: "null", text: "{{ .phone }}"},
+		{name: "missing lower", text: "{{ lower .mobile }}"},
+		{name: "missing join", text: `{{ join "," .groups }}`},
+		{name: "missing nested", text: "{{ .nested.org }}"},
+		{name: "missing parent", text: "{{ .org.name }}"},
+		{name: "text with missing", text: "Hello {{ .mobile }}"},
+		{name: "text with null", text: "Hello {{ .phone }}"},
+		{name: "one of claims missing", text: "{{ .email }} {{ .mobile }}"},
+		{name: "empty", text: "{{ .name }}"},
+		// default handles missing claims
+		{name: "default of missing", text: `{{ .mobile | default "none" }}`, want: "none"},
+		{name: "default of null", text: `{{ .phone | default "none" }}`, want: "none"},
+		{name: "default args", text: `{{ default "none" .nested.org }}`, want: "none"},
+		{name: "default of function", text: `{{ lower .mobile | default "none" }}`, want: "none"},
+		{name: "default of empty", text: `{{ .name | default "anonymous" }}`, want: "anonymous"},
+		{name: "text with default", text: `Hello {{ .mobile | default "guest" }}`, want: "Hello guest"},
+		// conditions are false for missing claims
+		{name: "if missing", text: `{{ if .mobile }}yes{{ else }}no{{ end }}`, want: "no"},
+		{name: "with present", text: `{{ with .nested }}{{ .team }}{{ end }}`, want: "core"},
+		{name: "field of string", text: "{{ .email.domain }}", wantErr: true},
+	}
+	for _, test := range tests {
+		ts, err := compileHeaders(map[string]string{"X-Test": test.text})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		headers, err := ts.execute(c)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", test.name, headers)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		want := map[string]string{}
+		if test.want != "" {
+			want["X-Test"] = test.want
+		}
+		if !reflect.DeepEqual(headers, want) {
+			t.Errorf("%s: expected headers %v, got %v", test.name, want, headers)
+		}
+	}
+
+	// no templates, no headers
+	if headers, err := headerTemplates(nil).execute(c); headers != nil || err != nil {
+		t.Errorf("expected no headers, got %v, %v", headers, err)
+	}
+}
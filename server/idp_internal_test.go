@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+var (
+	testIdPKey     *rsa.PrivateKey
+	testIdPKeyOnce sync.Once
+)
+
+// testIdP is a fake OpenID Connect provider serving discovery, JWKS, token and
+// UserInfo endpoints, tokens are signed by a RSA key shared by all test IdPs.
+type testIdP struct {
+	*httptest.Server
+
+	key    *rsa.PrivateKey
+	signer jose.Signer
+
+	// metadata is added to the discovery document
+	metadata map[string]interface{}
+	// token answers token requests by their form, the request fails with
+	// invalid_grant if it returns nil
+	token func(form url.Values) interface{}
+	// userInfo answers UserInfo requests, the request fails if it returns nil
+	userInfo func(r *http.Request) interface{}
+
+	mu            sync.Mutex
+	tokenRequests []url.Values
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	testIdPKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		testIdPKey = key
+	})
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: testIdPKey, KeyID: "test"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdP{key: testIdPKey, signer: signer, metadata: make(map[string]interface{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/keys", idp.keys)
+	mux.HandleFunc("/token", idp.tokenHandler)
+	mux.HandleFunc("/userinfo", idp.userInfoHandler)
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *testIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	doc := map[string]interface{}{
+		"issuer":                                idp.URL,
+		"authorization_endpoint":                idp.URL + "/auth",
+		"token_endpoint":                        idp.URL + "/token",
+		"jwks_uri":                              idp.URL + "/keys",
+		"userinfo_endpoint":                     idp.URL + "/userinfo",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	}
+	for k, v := range idp.metadata {
+		doc[k] = v
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
+
+func (idp *testIdP) keys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &idp.key.PublicKey,
+		KeyID:     "test",
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}}})
+}
+
+func (idp *testIdP) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	idp.mu.Lock()
+	idp.tokenRequests = append(idp.tokenRequests, r.PostForm)
+	idp.mu.Unlock()
+
+	var resp interface{}
+	if idp.token != nil {
+		resp = idp.token(r.PostForm)
+	}
+	if resp == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (idp *testIdP) userInfoHandler(w http.ResponseWriter, r *http.Request) {
+	var resp interface{}
+	if idp.userInfo != nil {
+		resp = idp.userInfo(r)
+	}
+	if resp == nil {
+		http.Error(w, "userinfo is unavailable", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// requests returns the forms of token requests received so far.
+func (idp *testIdP) requests() []url.Values {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return append([]url.Values(nil), idp.tokenRequests...)
+}
+
+// config returns a provider config of the IdP with client ID "app", users are
+// named by the name claim.
+func (idp *testIdP) config(name string) ProviderConfig {
+	return ProviderConfig{
+		Name:          name,
+		IssuerURL:     idp.URL,
+		RedirectURL:   "https://app.com/oidc/callback",
+		ClientID:      "app",
+		UsernameClaim: "name",
+	}
+}
+
+// sign signs the claims with the IdP key.
+func (idp *testIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	return signClaims(t, idp.signer, claims)
+}
+
+// idToken returns a signed token of subject u1 issued to "app" by the IdP,
+// extra claims replace the default ones, or remove them if nil.
+func (idp *testIdP) idToken(t *testing.T, extra map[string]interface{}) string {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":  idp.URL,
+		"aud":  "app",
+		"sub":  "u1",
+		"name": "tom",
+		"iat":  now.Unix(),
+		"exp":  now.Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+		claims[k] = v
+	}
+	return idp.sign(t, claims)
+}
+
+func signClaims(t *testing.T, signer jose.Signer, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultNegativeCacheTTL is how long an inactive token is cached, in seconds.
+	defaultNegativeCacheTTL = 60
+	// maxCachedResults caps the cache, so that a flood of random tokens can't grow it.
+	maxCachedResults = 10000
+)
+
+var errInactiveToken = errors.New("token is not active")
+
+// introspector validates opaque access tokens with OAuth2 Token Introspection,
+// https://tools.ietf.org/html/rfc7662. Results are cached by token hash, so
+// that IdP is not called on every request.
+type introspector struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+	// audiences are accepted aud or client_id of tokens
+	audiences []string
+
+	negativeTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]introspectionResult
+}
+
+type introspectionResult struct {
+	claims claims
+	err    error
+	expiry time.Time
+}
+
+// introspectionResponse holds the standard members of an introspection response.
+type introspectionResponse struct {
+	Active   bool          `json:"active"`
+	Exp      int64         `json:"exp"`
+	Audience stringOrArray `json:"aud"`
+	ClientID string        `json:"client_id"`
+}
+
+func newIntrospector(endpoint, clientID, clientSecret string, client *http.Client, audiences []string, negativeTTL int) *introspector {
+	if negativeTTL <= 0 {
+		negativeTTL = defaultNegativeCacheTTL
+	}
+	return &introspector{
+		endpoint:     endpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       client,
+		audiences:    audiences,
+		negativeTTL:  time.Duration(negativeTTL) * time.Second,
+		cache:        make(map[string]introspectionResult),
+	}
+}
+
+// introspect returns the claims of an active token, or errInactiveToken.
+func (i *introspector) introspect(ctx context.Context, token string) (claims, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	now := time.Now()
+	i.mu.Lock()
+	result, ok := i.cache[key]
+	i.mu.Unlock()
+	if ok && now.Before(result.expiry) {
+		return result.claims, result.err
+	}
+
+	c, resp, err := i.request(ctx, token)
+	if err != nil {
+		// don't cache failures of the request itself
+		return nil, err
+	}
+
+	result = introspectionResult{claims: c}
+	if resp.Active && !i.acceptAudience(resp) {
+		// token is issued for another client
+		result.err = fmt.Errorf("introspection: unexpected audience %q of client %q", resp.Audience, resp.ClientID)
+	}
+	switch {
+	case !resp.Active:
+		result.err = errInactiveToken
+		result.expiry = now.Add(i.negativeTTL)
+	case resp.Exp > 0:
+		result.expiry = time.Unix(resp.Exp, 0)
+	default:
+		// without exp, the result is not cached at all
+		return result.claims, result.err
+	}
+
+	i.mu.Lock()
+	if len(i.cache) >= maxCachedResults {
+		i.sweep(now)
+	}
+	i.cache[key] = result
+	i.mu.Unlock()
+
+	return result.claims, result.err
+}
+
+func (i *introspector) request(ctx context.Context, token string) (claims, *introspectionResponse, error) {
+	form := url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	}
+	if i.clientSecret == "" {
+		form.Set("client_id", i.clientID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, i.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+	}
+
+	resp, err := i.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, fmt.Errorf("introspection: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("introspection: read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("introspection: %s: %s", resp.Status, body)
+	}
+
+	var r introspectionResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, nil, fmt.Errorf("introspection: decode response: %v", err)
+	}
+	var c claims
+	if err := json.Unmarshal(body, &c); err != nil {
+		return nil, nil, fmt.Errorf("introspection: decode response: %v", err)
+	}
+	return c, &r, nil
+}
+
+// acceptAudience reports whether the aud or client_id of the active token is
+// any of the accepted audiences.
+func (i *introspector) acceptAudience(resp *introspectionResponse) bool {
+	return containsAny(resp.Audience, i.audiences) || containsAny([]string{resp.ClientID}, i.audiences)
+}
+
+// sweep removes expired results, and the results expiring soonest if the cache is
+// still full, must be called with mu held.
+func (i *introspector) sweep(now time.Time) {
+	for key, result := range i.cache {
+		if !now.Before(result.expiry) {
+			delete(i.cache, key)
+		}
+	}
+
+	for len(i.cache) >= maxCachedResults {
+		var oldest string
+		var expiry time.Time
+		for key, result := range i.cache {
+			if oldest == "" || result.expiry.Before(expiry) {
+				oldest, expiry = key, result.expiry
+			}
+		}
+		delete(i.cache, oldest)
+	}
+}
+
+// introspectBearer validates the opaque bearer token by introspection,
+// and maps the introspection response to identity.
+func (p *provider) introspectBearer(ctx context.Context, token string) (*identity, error) {
+	c, err := p.introspector.introspect(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &identity{claims: c, accessToken: token}
+	for _, name := range []string{p.usernameClaim, "username", "sub"} {
+		if err := c.unmarshalClaim(name, &id.username); err == nil && id.username != "" {
+			break
+		}
+	}
+	if id.username == "" {
+		return nil, errors.New("introspection: no username in response")
+	}
+
+	groupsClaim := p.groupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	if id.groups, err = c.extractGroups(groupsClaim); err != nil {
+		return nil, err
+	}
+
+	var scope string
+	if err := c.unmarshalClaim("scope", &scope); err == nil {
+		id.scopes = strings.Fields(scope)
+	}
+
+	var iat int64
+	if err := c.unmarshalClaim("iat", &iat); err == nil {
+		id.createdAt = time.Unix(iat, 0)
+	}
+
+	if id.headers, err = p.headers.execute(c); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
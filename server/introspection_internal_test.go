@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIntrospect(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	responses := map[string]string{
+		"aud":       fmt.Sprintf(`{"active":true,"exp":%d,"sub":"u1","aud":["other","my-app"]}`, exp),
+		"client_id": fmt.Sprintf(`{"active":true,"exp":%d,"sub":"u1","client_id":"my-app"}`, exp),
+		"other":     fmt.Sprintf(`{"active":true,"exp":%d,"sub":"u1","aud":"other","client_id":"other"}`, exp),
+		"none":      fmt.Sprintf(`{"active":true,"exp":%d,"sub":"u1"}`, exp),
+		"inactive":  `{"active":false}`,
+	}
+	requests := 0
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, responses[r.PostFormValue("token")])
+	}))
+	defer idp.Close()
+
+	i := newIntrospector(idp.URL, "my-app", "secret", idp.Client(), []string{"my-app"}, 60)
+	tests := []struct {
+		token string
+		valid bool
+	}{
+		{"aud", true},
+		{"client_id", true},
+		{"other", false},
+		{"none", false},
+		{"inactive", false},
+	}
+	for _, test := range tests {
+		for round := 0; round < 2; round++ {
+			_, err := i.introspect(context.Background(), test.token)
+			if test.valid && err != nil {
+				t.Errorf("token %s: expected to be valid, got %v", test.token, err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("token %s: expected to be invalid", test.token)
+			}
+		}
+	}
+	// the second round is served by cache
+	if requests != len(tests) {
+		t.Errorf("expected %d introspection requests, got %d", len(tests), requests)
+	}
+}
+
+func TestIntrospectionCacheLimit(t *testing.T) {
+	i := newIntrospector("", "my-app", "", nil, []string{"my-app"}, 60)
+	now := time.Now()
+	for n := 0; n < maxCachedResults; n++ {
+		i.cache[fmt.Sprint(n)] = introspectionResult{expiry: now.Add(time.Duration(n+1) * time.Second)}
+	}
+	i.cache["expired"] = introspectionResult{expiry: now.Add(-time.Second)}
+
+	i.sweep(now)
+	if len(i.cache) >= maxCachedResults {
+		t.Fatalf("expected cache to be under %d results, got %d", maxCachedResults, len(i.cache))
+	}
+	if _, ok := i.cache["expired"]; ok {
+		t.Error("expected expired result to be removed")
+	}
+	if _, ok := i.cache["0"]; ok {
+		t.Error("expected result expiring soonest to be removed")
+	}
+	if _, ok := i.cache[fmt.Sprint(maxCachedResults-1)]; !ok {
+		t.Error("expected result expiring latest to be kept")
+	}
+}
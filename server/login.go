@@ -0,0 +1,62 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var loginChooserTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html><head><title>Login</title></head><body>
+<h1>Login with</h1>
+<ul>
+{{- range .}}
+<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{- end}}
+</ul>
+</body></html>
+`))
+
+// loginChooser is the handler responsible for starting login with the provider in
+// parameter, or listing all providers for user to choose if there's none.
+func (s *Server) loginChooser(w http.ResponseWriter, r *http.Request) {
+	redirect := r.URL.Query().Get("rd")
+	if redirect == "" {
+		redirect = "/"
+	}
+
+	name := r.URL.Query().Get("provider")
+	if name != "" || len(s.providers) == 1 {
+		p := s.selectProvider(r)
+		if name != "" {
+			p = s.providerByName(name)
+		}
+		if p == nil {
+			http.Error(w, "invalid parameter: provider", http.StatusBadRequest)
+			return
+		}
+		s.startLogin(p, redirect, true, w, r)
+		return
+	}
+
+	type choice struct {
+		Name string
+		URL  string
+	}
+	choices := make([]choice, 0, len(s.providers))
+	for _, p := range s.providers {
+		u := url.URL{
+			Path:     r.URL.Path,
+			RawQuery: url.Values{"provider": {p.name}, "rd": {redirect}}.Encode(),
+		}
+		choices = append(choices, choice{Name: p.name, URL: u.String()})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	if err := loginChooserTemplate.Execute(w, choices); err != nil {
+		log.Errorf("server: render login chooser: %s", err)
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// backChannelLogoutEvent is the event member of logout token, see
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#LogoutToken
+const backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+const (
+	// logoutTokenMaxAge is how long a logout token is accepted after it's issued,
+	// ids of accepted tokens are remembered as long to reject replays.
+	logoutTokenMaxAge = 5 * time.Minute
+	// logoutTokenLeeway is the clock skew allowed for iat of logout tokens.
+	logoutTokenLeeway = time.Minute
+)
+
+// SessionIndex is implemented by session stores which can find sessions by index keys.
+type SessionIndex interface {
+	// Index records the saved session in the index of each key.
+	Index(session *sessions.Session, keys ...string) error
+	// DeleteIndexed deletes all the sessions in the index of key.
+	DeleteIndexed(key string) error
+}
+
+// ReplayCache is implemented by session stores which remember ids of used tokens.
+type ReplayCache interface {
+	// AddOnce records the key until ttl passes, it returns false if the key
+	// is recorded already.
+	AddOnce(key string, ttl time.Duration) (bool, error)
+}
+
+// sub and sid are only unique within an issuer, so their index keys are qualified
+// by the issuer, which tells apart the providers of all virtual hosts sharing the
+// session store.
+func indexKey(kind, issuer, value string) string {
+	if issuer == "" {
+		return kind + ":" + value
+	}
+	return kind + ":" + issuer + ":" + value
+}
+
+func subjectIndexKey(issuer, sub string) string {
+	return indexKey("sub", issuer, sub)
+}
+
+func sidIndexKey(issuer, sid string) string {
+	return indexKey("sid", issuer, sid)
+}
+
+func jtiKey(issuer, jti string) string {
+	return indexKey("jti", issuer, jti)
+}
+
+// userIndexKey is not qualified by issuer, so that operators find all the
+// sessions of a user name regardless of the provider. It's only used by the
+// admin API, sessions are limited per issuer and subject by limitIndexKey.
+func userIndexKey(user string) string {
+	return indexKey("user", "", user)
+}
+
+// sessionIndexKeys returns the index keys of a logged in session.
+func sessionIndexKeys(session *sessions.Session) []string {
+	var keys []string
+	issuer, _ := session.Values["issuer"].(string)
+	if sub, _ := session.Values["sub"].(string); sub != "" {
+		keys = append(keys, subjectIndexKey(issuer, sub))
+	}
+	if sid, _ := session.Values["sid"].(string); sid != "" {
+		keys = append(keys, sidIndexKey(issuer, sid))
+	}
+	if user, _ := session.Values["user_name"].(string); user != "" {
+		keys = append(keys, userIndexKey(user))
+	}
+	return keys
+}
+
+// saveSession saves the logged in session, and indexes it if the store supports.
+func (s *Server) saveSession(session *sessions.Session, w http.ResponseWriter, r *http.Request) error {
+	if err := session.Save(r, w); err != nil {
+		return err
+	}
+
+	if index, ok := s.store.(SessionIndex); ok {
+		if err := index.Index(session, sessionIndexKeys(session)...); err != nil {
+			return fmt.Errorf("index session: %v", err)
+		}
+	}
+	return nil
+}
+
+// backChannelLogout is the handler responsible for receiving logout token from provider,
+// and revoking all the sessions of the user or the provider session.
+func (s *Server) backChannelLogout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	index, ok := s.store.(SessionIndex)
+	if !ok {
+		http.Error(w, "back-channel logout is not supported by session storage", http.StatusNotImplemented)
+		return
+	}
+
+	token := r.PostFormValue("logout_token")
+	if token == "" {
+		http.Error(w, "missing required parameter: logout_token", http.StatusBadRequest)
+		return
+	}
+
+	// logout token is verified by the provider of its issuer
+	p, err := s.tokenProvider(token)
+	var key, jti string
+	if err == nil {
+		key, jti, err = p.verifyLogoutToken(r.Context(), token)
+	}
+	if err != nil {
+		log.Errorf("server: verify logout token: %s", err)
+		http.Error(w, "invalid logout token", http.StatusBadRequest)
+		return
+	}
+
+	// a logout token is only accepted once within its lifetime
+	if cache, ok := s.store.(ReplayCache); ok {
+		added, err := cache.AddOnce(jtiKey(p.issuerURL, jti), logoutTokenMaxAge+logoutTokenLeeway)
+		if err != nil {
+			log.Errorf("server: record logout token %s: %s", jti, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !added {
+			log.Errorf("server: verify logout token: jti %s is replayed", jti)
+			http.Error(w, "invalid logout token", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := index.DeleteIndexed(key); err != nil {
+		log.Errorf("server: delete sessions of %s: %s", key, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("server: back-channel logout sessions of %s", key)
+	w.WriteHeader(http.StatusOK)
+}
+
+// frontChannelLogoutPage is the page loaded by provider in an iframe, it has nothing to run.
+const frontChannelLogoutPage = `<!DOCTYPE html>
+<html><head><title>Logout</title></head><body>Logout successfully.</body></html>
+`
+
+// frontChannelLogout is the handler responsible for clearing the local session when
+// the provider renders it in an iframe, see https://openid.net/specs/openid-connect-frontchannel-1_0.html
+func (s *Server) frontChannelLogout(w http.ResponseWriter, r *http.Request) {
+	iss := r.URL.Query().Get("iss")
+	sid := r.URL.Query().Get("sid")
+	// iss and sid identify the provider session together, a request without
+	// either of them must not clear the session
+	if iss == "" || sid == "" {
+		http.Error(w, "missing required parameters: iss and sid", http.StatusBadRequest)
+		return
+	}
+	if s.providerByIssuer(iss) == nil {
+		http.Error(w, "invalid parameter: iss", http.StatusBadRequest)
+		return
+	}
+
+	session, err := s.authSession(r)
+	if err != nil {
+		log.Errorf("server: get session: %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// only clear the local session logged in by the provider session
+	if !session.IsNew && s.sessionIssuer(session) == iss {
+		if current, _ := session.Values["sid"].(string); sid == current {
+			deleteCookie(session, w, r)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(frontChannelLogoutPage)) // nolint
+}
+
+// sessionIssuer returns the issuer of the provider the session is logged in with.
+func (s *Server) sessionIssuer(session *sessions.Session) string {
+	if iss, ok := session.Values["issuer"].(string); ok {
+		return iss
+	}
+	if p, err := s.sessionProvider(session); err == nil {
+		return p.issuerURL
+	}
+	return ""
+}
+
+// verifyLogoutToken verifies the logout token and returns the index key of sessions
+// to be revoked, sid takes precedence over sub, and the jti of the token. Tokens are
+// only accepted within logoutTokenMaxAge since they're issued, and before exp if any.
+func (p *provider) verifyLogoutToken(ctx context.Context, token string) (string, string, error) {
+	// logout token is not required to have exp claim
+	verifier := p.oidc.Verifier(&oidc.Config{ClientID: p.oauth2Config.ClientID, SkipExpiryCheck: true})
+	t, err := verifier.Verify(ctx, token)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	if !t.Expiry.IsZero() && now.After(t.Expiry) {
+		return "", "", fmt.Errorf("token is expired at %s", t.Expiry)
+	}
+	switch {
+	case t.IssuedAt.IsZero():
+		return "", "", errors.New("no iat claim")
+	case t.IssuedAt.Before(now.Add(-logoutTokenMaxAge)):
+		return "", "", fmt.Errorf("token is issued too long ago at %s", t.IssuedAt)
+	case t.IssuedAt.After(now.Add(logoutTokenLeeway)):
+		return "", "", fmt.Errorf("token is issued in the future at %s", t.IssuedAt)
+	}
+
+	var c struct {
+		Sid    string                     `json:"sid"`
+		Jti    string                     `json:"jti"`
+		Nonce  *string                    `json:"nonce"`
+		Events map[string]json.RawMessage `json:"events"`
+	}
+	if err := t.Claims(&c); err != nil {
+		return "", "", fmt.Errorf("parse claims: %v", err)
+	}
+	if _, ok := c.Events[backChannelLogoutEvent]; !ok {
+		return "", "", errors.New("no back-channel logout event")
+	}
+	if c.Nonce != nil {
+		return "", "", errors.New("nonce is not allowed")
+	}
+	if c.Jti == "" {
+		return "", "", errors.New("no jti claim")
+	}
+
+	switch {
+	case c.Sid != "":
+		return sidIndexKey(p.issuerURL, c.Sid), c.Jti, nil
+	case t.Subject != "":
+		return subjectIndexKey(p.issuerURL, t.Subject), c.Jti, nil
+	default:
+		return "", "", errors.New("neither sid nor sub is present")
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+
+	"github.com/fezho/oidc-auth/storage/memory"
+)
+
+func TestFrontChannelLogout(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		wantCode    int
+		wantCleared bool
+	}{
+		{"no iss and sid", "", http.StatusBadRequest, false},
+		{"unknown iss", "?iss=https://evil.com&sid=s1", http.StatusBadRequest, false},
+		{"matching iss and sid", "?iss=https://idp.com&sid=s1", http.StatusOK, true},
+		{"other sid", "?iss=https://idp.com&sid=s2", http.StatusOK, false},
+		{"other issuer", "?iss=https://partner.com&sid=s1", http.StatusOK, false},
+		{"iss only", "?iss=https://idp.com", http.StatusBadRequest, false},
+		{"sid only", "?sid=s1", http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{
+				store:  memory.New(),
+				cookie: CookieConfig{Name: defaultSessionName},
+				providers: []*provider{
+					{issuerURL: "https://idp.com", oauth2Config: &oauth2.Config{ClientID: "app"}},
+					{name: "partner", issuerURL: "https://partner.com", oauth2Config: &oauth2.Config{ClientID: "app"}},
+				},
+			}
+
+			// log in a session of sid s1
+			r := httptest.NewRequest(http.MethodGet, "/login", nil)
+			session, err := s.authSession(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session.Values["issuer"] = "https://idp.com"
+			session.Values["client_id"] = "app"
+			session.Values["sid"] = "s1"
+			w := httptest.NewRecorder()
+			if err := session.Save(r, w); err != nil {
+				t.Fatal(err)
+			}
+
+			r = httptest.NewRequest(http.MethodGet, "/frontchannel_logout"+test.query, nil)
+			for _, c := range w.Result().Cookies() {
+				r.AddCookie(c)
+			}
+			w = httptest.NewRecorder()
+			s.frontChannelLogout(w, r)
+			if w.Code != test.wantCode {
+				t.Fatalf("expected code %d, got %d", test.wantCode, w.Code)
+			}
+
+			cleared := false
+			for _, c := range w.Result().Cookies() {
+				cleared = cleared || (c.Name == defaultSessionName && c.MaxAge < 0)
+			}
+			if cleared != test.wantCleared {
+				t.Errorf("expected session cleared %v, got %v", test.wantCleared, cleared)
+			}
+		})
+	}
+}
+
+func TestBackChannelLogout(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	p, err := newProvider(idp.config(""), BearerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := map[string]interface{}{backChannelLogoutEvent: map[string]interface{}{}}
+	tests := []struct {
+		name string
+		// claims replace the ones of a valid token, or remove them if nil
+		claims   map[string]interface{}
+		replayed bool
+		wantCode int
+	}{
+		{"valid", nil, false, http.StatusOK},
+		{"sub only", map[string]interface{}{"sid": nil}, false, http.StatusOK},
+		{"sid only", map[string]interface{}{"sub": nil}, false, http.StatusOK},
+		{"no events", map[string]interface{}{"events": nil}, false, http.StatusBadRequest},
+		{"other event", map[string]interface{}{"events": map[string]interface{}{"other": map[string]interface{}{}}}, false, http.StatusBadRequest},
+		{"nonce", map[string]interface{}{"nonce": "n"}, false, http.StatusBadRequest},
+		{"neither sid nor sub", map[string]interface{}{"sid": nil, "sub": nil}, false, http.StatusBadRequest},
+		{"wrong aud", map[string]interface{}{"aud": "other"}, false, http.StatusBadRequest},
+		{"expired", map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}, false, http.StatusBadRequest},
+		{"no exp", map[string]interface{}{"exp": nil}, false, http.StatusOK},
+		{"no iat", map[string]interface{}{"iat": nil}, false, http.StatusBadRequest},
+		{"old iat", map[string]interface{}{"iat": time.Now().Add(-logoutTokenMaxAge - time.Minute).Unix()}, false, http.StatusBadRequest},
+		{"future iat", map[string]interface{}{"iat": time.Now().Add(logoutTokenLeeway + time.Minute).Unix()}, false, http.StatusBadRequest},
+		{"no jti", map[string]interface{}{"jti": nil}, false, http.StatusBadRequest},
+		{"replayed jti", nil, true, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := memory.New()
+			s := &Server{store: store, cookie: CookieConfig{Name: defaultSessionName}, providers: []*provider{p}}
+
+			// log in a session of sub u1 and sid s1
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			session, err := s.authSession(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session.Values["user_name"] = "tom"
+			session.Values["issuer"] = idp.URL
+			session.Values["sub"] = "u1"
+			session.Values["sid"] = "s1"
+			if err := s.saveSession(session, httptest.NewRecorder(), r); err != nil {
+				t.Fatal(err)
+			}
+
+			claims := map[string]interface{}{"sid": "s1", "jti": test.name, "events": event}
+			for k, v := range test.claims {
+				claims[k] = v
+			}
+			token := idp.idToken(t, claims)
+			logout := func() *httptest.ResponseRecorder {
+				form := url.Values{"logout_token": {token}}
+				r := httptest.NewRequest(http.MethodPost, "/oidc/backchannel_logout", strings.NewReader(form.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				w := httptest.NewRecorder()
+				s.backChannelLogout(w, r)
+				return w
+			}
+			if test.replayed {
+				if w := logout(); w.Code != http.StatusOK {
+					t.Fatalf("expected first logout to succeed, got code %d", w.Code)
+				}
+			}
+
+			w := logout()
+			if w.Code != test.wantCode {
+				t.Fatalf("expected code %d, got %d: %s", test.wantCode, w.Code, w.Body)
+			}
+			_, exists, err := store.Lookup(session.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantExists := test.wantCode != http.StatusOK && !test.replayed; exists != wantExists {
+				t.Errorf("expected session exists %v, got %v", wantExists, exists)
+			}
+		})
+	}
+}
+
+func TestSessionIndexKeys(t *testing.T) {
+	session := sessions.NewSession(nil, defaultSessionName)
+	session.Values["provider"] = ""
+	session.Values["issuer"] = "https://a.idp.com"
+	session.Values["sub"] = "u1"
+	session.Values["sid"] = "s1"
+	session.Values["user_name"] = "tom"
+
+	want := []string{"sub:https://a.idp.com:u1", "sid:https://a.idp.com:s1", "user:tom"}
+	got := sessionIndexKeys(session)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expected keys %q, got %q", want, got)
+	}
+
+	// logout token of another tenant's issuer doesn't revoke the session
+	for _, key := range []string{subjectIndexKey("https://b.idp.com", "u1"), sidIndexKey("https://b.idp.com", "s1")} {
+		for _, k := range got {
+			if k == key {
+				t.Errorf("unexpected key %q of another issuer", key)
+			}
+		}
+	}
+}
@@ -18,6 +18,19 @@ func (c claims) unmarshalClaim(name string, v interface{}) error {
 	return json.Unmarshal([]byte(val), v)
 }
 
+// toMap decodes all the claims into generic values.
+func (c claims) toMap() (map[string]interface{}, error) {
+	m := make(map[string]interface{}, len(c))
+	for name, val := range c {
+		var v interface{}
+		if err := json.Unmarshal(val, &v); err != nil {
+			return nil, fmt.Errorf("oidc: parse claim %q: %v", name, err)
+		}
+		m[name] = v
+	}
+	return m, nil
+}
+
 func (c claims) hasClaim(name string) bool {
 	if _, ok := c[name]; !ok {
 		return false
@@ -71,6 +84,33 @@ func (c claims) extractGroups(groupsClaim string) ([]string, error) {
 	return nil, nil
 }
 
+// matchClaim reports whether the claim matches any of the values. Booleans and numbers are
+// compared with their JSON form, and a list claim matches if any of its elements matches.
+func (c claims) matchClaim(name string, values []string) bool {
+	val, ok := c[name]
+	if !ok {
+		return false
+	}
+
+	var elems []json.RawMessage
+	if err := json.Unmarshal(val, &elems); err != nil {
+		elems = []json.RawMessage{val}
+	}
+
+	for _, elem := range elems {
+		var str string
+		if err := json.Unmarshal(elem, &str); err != nil {
+			str = string(elem)
+		}
+		for _, v := range values {
+			if str == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (s *stringOrArray) UnmarshalJSON(b []byte) error {
 	var a []string
 	if err := json.Unmarshal(b, &a); err == nil {
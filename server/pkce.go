@@ -0,0 +1,41 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/oauth2"
+)
+
+// Proof Key for Code Exchange by OAuth Public Clients
+// https://tools.ietf.org/html/rfc7636
+const codeChallengeMethodS256 = "S256"
+
+// newCodeVerifier generates a high-entropy cryptographic random code_verifier,
+// 32 octets are encoded to a 43 characters long URL safe string.
+func newCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("pkce: generate code verifier: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallengeOptions returns the auth code options which carry the S256
+// code_challenge derived from the verifier.
+func codeChallengeOptions(verifier string) []oauth2.AuthCodeOption {
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", challenge),
+		oauth2.SetAuthURLParam("code_challenge_method", codeChallengeMethodS256),
+	}
+}
+
+// codeVerifierOption returns the auth code option which presents the
+// code_verifier in token request.
+func codeVerifierOption(verifier string) oauth2.AuthCodeOption {
+	return oauth2.SetAuthURLParam("code_verifier", verifier)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/fezho/oidc-auth/storage/memory"
+)
+
+func TestCodeChallengeS256(t *testing.T) {
+	// https://tools.ietf.org/html/rfc7636#appendix-B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: "https://idp.com/auth"}}
+	u, err := url.Parse(config.AuthCodeURL("state", codeChallengeOptions(verifier)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if got, want := query.Get("code_challenge"), "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("expected code challenge %q, got %q", want, got)
+	}
+	if got := query.Get("code_challenge_method"); got != codeChallengeMethodS256 {
+		t.Errorf("expected code challenge method S256, got %q", got)
+	}
+}
+
+func TestNewCodeVerifier(t *testing.T) {
+	a, err := newCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 43 {
+		t.Errorf("expected verifier of 43 characters, got %d", len(a))
+	}
+	if a == b {
+		t.Error("expected random verifiers")
+	}
+}
+
+func TestCallbackSendsCodeVerifier(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	// authorization code is the nonce of the login in this test
+	idp.token = func(form url.Values) interface{} {
+		return map[string]interface{}{
+			"access_token":  "at",
+			"token_type":    "Bearer",
+			"refresh_token": "rt",
+			"id_token":      idp.idToken(t, map[string]interface{}{"nonce": form.Get("code")}),
+		}
+	}
+	config := idp.config("")
+	config.OfflineAccess = true
+	s, err := NewServer(Config{Providers: []ProviderConfig{config}, Store: memory.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := startTestLogin(t, s, jar, jarRequest(jar, "http://app.com/"))
+	if query.Get("code_challenge_method") != codeChallengeMethodS256 || query.Get("code_challenge") == "" {
+		t.Fatalf("expected S256 code challenge in authorization request, got %q", query.Encode())
+	}
+	if got := query.Get("access_type"); got != "" {
+		t.Errorf("unexpected access_type %q in authorization request", got)
+	}
+
+	callback := "http://app.com/oidc/callback?" + url.Values{"code": {query.Get("nonce")}, "state": {query.Get("state")}}.Encode()
+	if w := serveWithJar(s, jar, jarRequest(jar, callback)); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected login to complete, got code %d: %s", w.Code, w.Body)
+	}
+
+	requests := idp.requests()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 token request, got %d", len(requests))
+	}
+	verifier := requests[0].Get("code_verifier")
+	sum := sha256.Sum256([]byte(verifier))
+	if got := base64.RawURLEncoding.EncodeToString(sum[:]); got != query.Get("code_challenge") {
+		t.Errorf("expected code verifier of the challenge %q, got %q", query.Get("code_challenge"), verifier)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// identity is the authenticated user of a request.
+type identity struct {
+	username string
+	groups   []string
+	claims   claims
+	// scopes granted to the bearer token, only set by introspection
+	scopes []string
+	// createdAt is the time when user logged in
+	createdAt time.Time
+	// headers are rendered from claims by header templates
+	headers map[string]string
+	// tokens of the user, which may be forwarded to upstream
+	idToken     string
+	accessToken string
+}
+
+// identityFromSession restores the identity saved in session by authenticateToken.
+func identityFromSession(session *sessions.Session) *identity {
+	id := &identity{}
+	id.username, _ = session.Values["user_name"].(string)
+	id.groups, _ = session.Values["user_groups"].([]string)
+	id.headers, _ = session.Values["headers"].(map[string]string)
+	id.idToken, _ = session.Values["id_token"].(string)
+	id.accessToken, _ = session.Values["access_token"].(string)
+	if createdAt, ok := session.Values["created_at"].(int64); ok {
+		id.createdAt = time.Unix(createdAt, 0)
+	}
+	if raw, ok := session.Values["claims"].(string); ok {
+		if err := json.Unmarshal([]byte(raw), &id.claims); err != nil {
+			log.Warnf("server: parse claims in session: %s", err)
+		}
+	}
+	return id
+}
+
+// identityFromClaims extracts the identity from verified token claims, and renders headers with them.
+func (p *provider) identityFromClaims(c claims) (*identity, error) {
+	username, err := c.extractUsername(p.usernameClaim)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &identity{username: username, claims: c}
+	if len(p.groupsClaim) > 0 {
+		if id.groups, err = c.extractGroups(p.groupsClaim); err != nil {
+			return nil, err
+		}
+	}
+	if id.headers, err = p.headers.execute(c); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+func (id *identity) inGroup(group string) bool {
+	for _, g := range id.groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) hasPolicy() bool {
+	return len(r.AnyGroups) > 0 || len(r.AllGroups) > 0 || len(r.Claims) > 0 || r.Expression != ""
+}
+
+// authorize checks the identity against authorization policies of the rule,
+// the returned error describes why the access is denied.
+func (r *rule) authorize(id *identity, req *http.Request) error {
+	if len(r.AnyGroups) > 0 {
+		allowed := false
+		for _, g := range r.AnyGroups {
+			if id.inGroup(g) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("user %q is not a member of any of groups %q", id.username, r.AnyGroups)
+		}
+	}
+
+	for _, g := range r.AllGroups {
+		if !id.inGroup(g) {
+			return fmt.Errorf("user %q is not a member of group %q", id.username, g)
+		}
+	}
+
+	for name, values := range r.Claims {
+		if !id.claims.matchClaim(name, values) {
+			return fmt.Errorf("claim %q of user %q doesn't match any of %q", name, id.username, values)
+		}
+	}
+
+	if r.program != nil {
+		allowed, err := evalExpression(r.program, id, req)
+		if err != nil {
+			return fmt.Errorf("evaluate expression %q: %v", r.Expression, err)
+		}
+		if !allowed {
+			return fmt.Errorf("user %q doesn't satisfy expression %q", id.username, r.Expression)
+		}
+	}
+
+	return nil
+}
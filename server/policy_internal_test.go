@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthorize(t *testing.T) {
+	tom := &identity{
+		username: "tom",
+		groups:   []string{"dev", "ops"},
+		claims: claims{
+			"email_verified": json.RawMessage(`true`),
+			"department":     json.RawMessage(`"engineering"`),
+			"roles":          json.RawMessage(`["admin","viewer"]`),
+			"level":          json.RawMessage(`3`),
+		},
+	}
+	tests := []struct {
+		name string
+		rule Rule
+		want bool
+	}{
+		{"no policy", Rule{}, true},
+		{"any groups", Rule{AnyGroups: []string{"qa", "ops"}}, true},
+		{"none of any groups", Rule{AnyGroups: []string{"qa", "hr"}}, false},
+		{"all groups", Rule{AllGroups: []string{"dev", "ops"}}, true},
+		{"not all groups", Rule{AllGroups: []string{"dev", "qa"}}, false},
+		{"any and all groups", Rule{AnyGroups: []string{"qa", "dev"}, AllGroups: []string{"ops"}}, true},
+		{"any but not all groups", Rule{AnyGroups: []string{"dev"}, AllGroups: []string{"qa"}}, false},
+		{"string claim", Rule{Claims: map[string][]string{"department": {"sales", "engineering"}}}, true},
+		{"string claim mismatch", Rule{Claims: map[string][]string{"department": {"sales"}}}, false},
+		{"list claim", Rule{Claims: map[string][]string{"roles": {"admin"}}}, true},
+		{"list claim mismatch", Rule{Claims: map[string][]string{"roles": {"owner"}}}, false},
+		{"bool claim", Rule{Claims: map[string][]string{"email_verified": {"true"}}}, true},
+		{"number claim", Rule{Claims: map[string][]string{"level": {"3"}}}, true},
+		{"missing claim", Rule{Claims: map[string][]string{"tenant": {"a"}}}, false},
+		{"all claims", Rule{Claims: map[string][]string{"roles": {"viewer"}, "department": {"engineering"}}}, true},
+		{"one of claims mismatch", Rule{Claims: map[string][]string{"roles": {"viewer"}, "department": {"sales"}}}, false},
+		{"groups and claims", Rule{AllGroups: []string{"dev"}, Claims: map[string][]string{"roles": {"admin"}}}, true},
+		{"groups but not claims", Rule{AllGroups: []string{"dev"}, Claims: map[string][]string{"roles": {"owner"}}}, false},
+	}
+	for _, test := range tests {
+		rs, err := compileRules([]Rule{test.rule})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		err = rs[0].authorize(tom, httptest.NewRequest("GET", "/", nil))
+		if got := err == nil; got != test.want {
+			t.Errorf("%s: expected allowed %v, got error %v", test.name, test.want, err)
+		}
+	}
+
+	// user without groups and claims
+	rs, err := compileRules([]Rule{{AnyGroups: []string{"dev"}}, {Claims: map[string][]string{"roles": {"admin"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous := &identity{username: "jerry"}
+	for _, r := range rs {
+		if err := r.authorize(anonymous, httptest.NewRequest("GET", "/", nil)); err == nil {
+			t.Errorf("expected %v to deny user without groups and claims", r.Rule)
+		}
+	}
+}
+
+func TestAuthorizeExpression(t *testing.T) {
+	tom := &identity{
+		username: "tom",
+		groups:   []string{"dev", "ops"},
+		claims: claims{
+			"email":      json.RawMessage(`"tom@corp.com"`),
+			"department": json.RawMessage(`"engineering"`),
+			"roles":      json.RawMessage(`["admin","viewer"]`),
+			"level":      json.RawMessage(`3`),
+			"address":    json.RawMessage(`{"country":"NL"}`),
+		},
+		createdAt: time.Now().Add(-2 * time.Hour),
+	}
+	r := httptest.NewRequest("POST", "http://app.corp.com/admin/../api/users", nil)
+	r.Header.Set("X-Team", "core")
+	r.Header.Add("X-Team", "infra")
+
+	tests := []struct {
+		name string
+		expr string
+		want bool
+	}{
+		{"user", `user == "tom"`, true},
+		{"group", `"ops" in groups`, true},
+		{"not in group", `"qa" in groups`, false},
+		{"all groups", `["dev", "ops"].all(g, g in groups)`, true},
+		{"string claim", `claims.department == "engineering"`, true},
+		{"string claim mismatch", `claims.department == "sales"`, false},
+		{"string claim function", `claims.email.endsWith("@corp.com")`, true},
+		{"list claim", `"admin" in claims.roles`, true},
+		{"number claim", `claims.level >= 3.0`, true},
+		{"nested claim", `claims.address.country == "NL"`, true},
+		{"index claim", `claims["department"] == "engineering"`, true},
+		// missing claims are denied rather than panicking
+		{"missing claim", `claims.tenant == "a"`, false},
+		{"missing nested claim", `claims.address.city == "Amsterdam"`, false},
+		{"negated missing claim", `!(claims.tenant == "a")`, false},
+		{"has missing claim", `has(claims.tenant) && claims.tenant == "a"`, false},
+		{"has not missing claim", `!has(claims.tenant)`, true},
+		{"method", `method == "POST"`, true},
+		{"method mismatch", `method in ["GET", "HEAD"]`, false},
+		{"host", `host.endsWith(".corp.com")`, true},
+		{"cleaned path", `path.startsWith("/api/")`, true},
+		{"uncleaned path", `path.startsWith("/admin/")`, false},
+		{"header", `headers["x-team"] == "core,infra"`, true},
+		{"header of name case", `"X-Team" in headers`, false},
+		{"missing header", `headers["x-tenant"] == "a"`, false},
+		{"session age", `session_age < duration("8h")`, true},
+		{"session too old", `session_age < duration("1h")`, false},
+		{"combined", `"dev" in groups && method == "POST" && claims.level >= 3.0`, true},
+	}
+	for _, test := range tests {
+		rs, err := compileRules([]Rule{{Expression: test.expr}})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		err = rs[0].authorize(tom, r)
+		if got := err == nil; got != test.want {
+			t.Errorf("%s: expected allowed %v, got error %v", test.name, test.want, err)
+		}
+	}
+
+	// user without groups and claims, logged in by bearer token
+	rs, err := compileRules([]Rule{{Expression: `"dev" in groups`}, {Expression: `claims.department == "engineering"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous := &identity{username: "jerry"}
+	for _, rule := range rs {
+		if err := rule.authorize(anonymous, r); err == nil {
+			t.Errorf("expected %q to deny user without groups and claims", rule.Expression)
+		}
+	}
+}
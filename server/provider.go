@@ -0,0 +1,329 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/coreos/go-oidc"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// ProviderConfig is the configuration of an OpenID Connect provider.
+type ProviderConfig struct {
+	// Name identifies the provider in sessions and the login chooser,
+	// it's required if there are more than one providers.
+	Name string
+	// Dex server address, Optional.
+	DexAddress string
+	// URL of the OpenID Connect issuer
+	IssuerURL string
+	// callback url for OpenID Connect Provider response.
+	RedirectURL string
+	// OAuth2 client ID of this application
+	ClientID string
+	// OAuth2 client secret of this application
+	ClientSecret string
+	// Scope specifies optional requested permissions
+	Scopes []string
+	// UsernameClaim is the JWT field to use as the user's username.
+	UsernameClaim string
+	// GroupsClaim, if specified, causes the OIDCAuthenticator to try to populate the user's
+	// groups with an ID Token field. If the GroupsClaim field is present in an ID Token the value
+	// must be a string or list of strings.
+	GroupsClaim string
+	// Whether to use AccessTypeOffline or not
+	OfflineAccess bool
+	// PostLogoutRedirectURIs are allowed URIs to redirect to after logout,
+	// the first one is used if no redirect parameter is given.
+	PostLogoutRedirectURIs []string
+	// DisablePKCE disables Proof Key for Code Exchange, which is used by default.
+	DisablePKCE bool
+	// PublicClient indicates the application is a public OAuth2 client without
+	// client secret, PKCE must be enabled for public clients.
+	PublicClient bool
+	// StoreAccessToken stores the access token in session, so that it could be
+	// forwarded to upstream.
+	StoreAccessToken bool
+	// UserInfo fetches claims from the UserInfo endpoint after login and refresh,
+	// for providers which leave claims like email and groups out of the ID token.
+	UserInfo bool
+	// UserInfoPrecedence decides whether the ID token or UserInfo claims are kept
+	// if both have a claim, default to the ID token ones.
+	UserInfoPrecedence UserInfoPrecedence
+	// Hosts selects the provider for requests to any of the host patterns,
+	// a leading "*." matches any subdomain.
+	Hosts []string
+	// PathPrefixes selects the provider for requests to any of the path prefixes,
+	// which match whole path segments of the cleaned path.
+	PathPrefixes []string
+}
+
+// provider is an OpenID Connect provider users can login with.
+type provider struct {
+	name         string
+	issuerURL    string
+	oidc         *oidc.Provider
+	oauth2Config *oauth2.Config
+	// client sends requests to the provider
+	client *http.Client
+
+	usernameClaim string
+	groupsClaim   string
+	offlineAccess bool
+	pkce          bool
+	authCodeOpts  []oauth2.AuthCodeOption
+	introspector  *introspector
+	// storeAccessToken keeps the access token in session
+	storeAccessToken bool
+	// userInfo merges the UserInfo claims into the ID token claims
+	userInfo           bool
+	userInfoPrecedence UserInfoPrecedence
+	// headers are shared by all providers of a server
+	headers headerTemplates
+
+	endSessionEndpoint     string
+	postLogoutRedirectURIs []string
+
+	// callbackPath is the path of RedirectURL
+	callbackPath string
+
+	hosts        []string
+	pathPrefixes []string
+
+	// refreshes serializes refreshes of sessions
+	refreshes refreshGroup
+}
+
+func newProvider(config ProviderConfig, bearer BearerConfig) (*provider, error) {
+	redirectURL, err := url.Parse(config.RedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse redirect URL %q", config.RedirectURL)
+	}
+
+	if config.PublicClient && config.DisablePKCE {
+		return nil, errors.New("PKCE is required for public client")
+	}
+
+	if err := config.UserInfoPrecedence.Validate(); err != nil {
+		return nil, err
+	}
+
+	client := http.DefaultClient
+	if config.DexAddress != "" {
+		client = &http.Client{
+			Transport: NewDexRewriteURLRoundTripper(config.DexAddress, http.DefaultTransport),
+		}
+	}
+	ctx := oidc.ClientContext(context.Background(), client)
+	op, err := oidc.NewProvider(ctx, config.IssuerURL)
+	if err != nil {
+		return nil, errors.Errorf("can't get oidc provider %q: %v", config.IssuerURL, err)
+	}
+
+	// This is the only mandatory scope and will return a sub claim
+	// which represents a unique identifier for the authenticated user.
+	oidcScopes := append(config.Scopes, oidc.ScopeOpenID)
+
+	endpoint := op.Endpoint()
+	if config.PublicClient {
+		// public client has no secret to authenticate with, sends client_id in params instead
+		endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
+
+	p := &provider{
+		name:      config.Name,
+		issuerURL: config.IssuerURL,
+		oidc:      op,
+		client:    client,
+		oauth2Config: &oauth2.Config{
+			RedirectURL:  config.RedirectURL,
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint:     endpoint,
+			Scopes:       oidcScopes,
+		},
+		usernameClaim:    config.UsernameClaim,
+		groupsClaim:      config.GroupsClaim,
+		offlineAccess:    config.OfflineAccess,
+		pkce:             !config.DisablePKCE,
+		storeAccessToken: config.StoreAccessToken,
+		userInfo:         config.UserInfo,
+		callbackPath:     redirectURL.Path,
+		hosts:            config.Hosts,
+		pathPrefixes:     config.PathPrefixes,
+
+		postLogoutRedirectURIs: config.PostLogoutRedirectURIs,
+		userInfoPrecedence:     config.UserInfoPrecedence,
+	}
+	if config.OfflineAccess {
+		p.authCodeOpts = append(p.authCodeOpts, oauth2.AccessTypeOffline)
+	}
+
+	var metadata struct {
+		EndSessionEndpoint    string `json:"end_session_endpoint"`
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
+	}
+	if err := op.Claims(&metadata); err != nil {
+		return nil, errors.Errorf("parse provider metadata: %v", err)
+	}
+	p.endSessionEndpoint = metadata.EndSessionEndpoint
+
+	if bearer.Mode == BearerIntrospection {
+		endpoint := bearer.IntrospectionEndpoint
+		if endpoint == "" {
+			endpoint = metadata.IntrospectionEndpoint
+		}
+		if endpoint == "" {
+			return nil, errors.New("provider has no token introspection endpoint")
+		}
+		audiences := bearer.Audiences
+		if len(audiences) == 0 {
+			audiences = []string{config.ClientID}
+		}
+		p.introspector = newIntrospector(endpoint, config.ClientID, config.ClientSecret, client, audiences, bearer.NegativeCacheTTL)
+	}
+
+	return p, nil
+}
+
+// callbackDir is the directory of callback path, which handlers of the server are registered under.
+func (p *provider) callbackDir() string {
+	return path.Dir(p.callbackPath)
+}
+
+// match reports whether the request is selected for the provider by host or path prefix.
+// A provider without hosts and path prefixes doesn't match any request.
+func (p *provider) match(r *http.Request) bool {
+	if len(p.hosts) == 0 && len(p.pathPrefixes) == 0 {
+		return false
+	}
+	if len(p.hosts) > 0 {
+		matched := false
+		for _, pattern := range p.hosts {
+			if matchHost(pattern, r.Host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(p.pathPrefixes) > 0 {
+		reqPath := cleanPath(r.URL.Path)
+		for _, prefix := range p.pathPrefixes {
+			if matchPathPrefix(prefix, reqPath) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// defaultProvider is the first configured provider.
+func (s *Server) defaultProvider() *provider {
+	return s.providers[0]
+}
+
+// selectProvider returns the provider to login with for the request, or nil
+// if it can't be decided and user has to choose one.
+func (s *Server) selectProvider(r *http.Request) *provider {
+	if len(s.providers) == 1 {
+		return s.defaultProvider()
+	}
+	for _, p := range s.providers {
+		if p.match(r) {
+			return p
+		}
+	}
+	return nil
+}
+
+// providerSelected reports whether p may authenticate the request, which is
+// false if the request is assigned to another provider.
+func (s *Server) providerSelected(r *http.Request, p *provider) bool {
+	selected := s.selectProvider(r)
+	return selected == nil || selected == p
+}
+
+func (s *Server) providerByName(name string) *provider {
+	for _, p := range s.providers {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *Server) providerByIssuer(iss string) *provider {
+	for _, p := range s.providers {
+		if p.issuerURL == iss {
+			return p
+		}
+	}
+	return nil
+}
+
+// sessionProvider returns the provider the session is logged in with, sessions
+// created before multiple providers are supported belong to the default provider.
+// Virtual hosts may share the session store, so the session must be logged in with
+// the issuer and client of the provider, sessions of other tenants are rejected.
+// Sessions created before the issuer and client are recorded belong to the
+// default provider as well, so that users aren't logged out by the upgrade.
+func (s *Server) sessionProvider(session *sessions.Session) (*provider, error) {
+	name, ok := session.Values["provider"].(string)
+	p := s.defaultProvider()
+	if ok {
+		if p = s.providerByName(name); p == nil {
+			return nil, fmt.Errorf("unknown provider %q of session", name)
+		}
+	}
+
+	issuer, hasIssuer := session.Values["issuer"].(string)
+	clientID, hasClientID := session.Values["client_id"].(string)
+	if !hasIssuer && !hasClientID {
+		return p, nil
+	}
+	if issuer != p.issuerURL || clientID != p.oauth2Config.ClientID {
+		return nil, fmt.Errorf("session of issuer %q and client %q doesn't belong to provider %q", issuer, clientID, p.name)
+	}
+	return p, nil
+}
+
+// tokenProvider returns the provider which issued the JWT, the token is not
+// verified here but by the returned provider.
+func (s *Server) tokenProvider(token string) (*provider, error) {
+	if len(s.providers) == 1 {
+		return s.defaultProvider(), nil
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed jwt")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt payload: %v", err)
+	}
+	var c struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, fmt.Errorf("malformed jwt payload: %v", err)
+	}
+
+	p := s.providerByIssuer(c.Issuer)
+	if p == nil {
+		return nil, fmt.Errorf("unknown issuer %q", c.Issuer)
+	}
+	return p, nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+func TestProviderSelected(t *testing.T) {
+	corp := &provider{name: "corp", hosts: []string{"*.corp.com"}}
+	contractor := &provider{name: "contractor", pathPrefixes: []string{"/contractor"}}
+	fallback := &provider{name: "default"}
+	s := &Server{providers: []*provider{fallback, corp, contractor}}
+
+	tests := []struct {
+		url  string
+		p    *provider
+		want bool
+	}{
+		{"http://app.corp.com/", corp, true},
+		{"http://app.corp.com/", contractor, false},
+		{"http://app.corp.com/", fallback, false},
+		{"http://app.com/contractor/docs", contractor, true},
+		{"http://app.com/contractor/docs", corp, false},
+		{"http://app.com/contractor/../admin", contractor, true},
+		{"http://app.com/contractor/../admin", fallback, true},
+		{"http://app.com/contractors", contractor, true},
+		{"http://app.com/contractors", corp, true},
+		{"http://app.com/", fallback, true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		if got := s.providerSelected(r, test.p); got != test.want {
+			t.Errorf("%s by %s: expected %v, got %v", test.url, test.p.name, test.want, got)
+		}
+	}
+
+	// the only provider is always selected
+	s = &Server{providers: []*provider{corp}}
+	if !s.providerSelected(httptest.NewRequest("GET", "http://app.com/", nil), corp) {
+		t.Error("expected the only provider to be selected")
+	}
+}
+
+func TestSessionProvider(t *testing.T) {
+	corp := &provider{name: "corp", issuerURL: "https://corp.com", oauth2Config: &oauth2.Config{ClientID: "app"}}
+	partner := &provider{name: "partner", issuerURL: "https://partner.com", oauth2Config: &oauth2.Config{ClientID: "app"}}
+	s := &Server{providers: []*provider{corp, partner}}
+
+	tests := []struct {
+		name   string
+		values map[interface{}]interface{}
+		want   *provider
+	}{
+		{"corp", map[interface{}]interface{}{"provider": "corp", "issuer": "https://corp.com", "client_id": "app"}, corp},
+		{"partner", map[interface{}]interface{}{"provider": "partner", "issuer": "https://partner.com", "client_id": "app"}, partner},
+		{"unknown provider", map[interface{}]interface{}{"provider": "other", "issuer": "https://corp.com", "client_id": "app"}, nil},
+		{"other issuer", map[interface{}]interface{}{"provider": "corp", "issuer": "https://partner.com", "client_id": "app"}, nil},
+		{"other client", map[interface{}]interface{}{"provider": "corp", "issuer": "https://corp.com", "client_id": "other"}, nil},
+		{"no client", map[interface{}]interface{}{"provider": "corp", "issuer": "https://corp.com"}, nil},
+		{"another tenant", map[interface{}]interface{}{"provider": "", "issuer": "https://tenant.com", "client_id": "app"}, nil},
+		{"no provider", map[interface{}]interface{}{"issuer": "https://corp.com", "client_id": "app"}, corp},
+		// sessions created before issuer and client are recorded
+		{"legacy", map[interface{}]interface{}{"user_name": "tom"}, corp},
+		{"legacy of provider", map[interface{}]interface{}{"provider": "partner", "user_name": "tom"}, partner},
+		{"legacy of unknown provider", map[interface{}]interface{}{"provider": "other", "user_name": "tom"}, nil},
+	}
+	for _, test := range tests {
+		session := sessions.NewSession(nil, defaultSessionName)
+		session.Values = test.values
+		p, err := s.sessionProvider(session)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected session to be rejected, got provider %q", test.name, p.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if p != test.want {
+			t.Errorf("%s: expected provider %q, got %q", test.name, test.want.name, p.name)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyHeaders are the headers of the original request set by a proxy in auth requests.
+type proxyHeaders struct {
+	method string
+	proto  string
+	host   string
+	// uri is the request URI, i.e. path and query
+	uri string
+	// url is the full URL, which takes precedence over the others
+	url string
+}
+
+// proxyPresets are the headers set by popular proxies.
+var proxyPresets = map[string]proxyHeaders{
+	// https://docs.traefik.io/middlewares/forwardauth/
+	"traefik": {
+		method: "X-Forwarded-Method",
+		proto:  "X-Forwarded-Proto",
+		host:   "X-Forwarded-Host",
+		uri:    "X-Forwarded-Uri",
+	},
+	// http://nginx.org/en/docs/http/ngx_http_auth_request_module.html, the headers are
+	// the ones set by ingress-nginx, which are commonly used in auth_request setups.
+	"nginx": {
+		method: "X-Original-Method",
+		proto:  "X-Forwarded-Proto",
+		host:   "X-Forwarded-Host",
+		uri:    "X-Original-URI",
+		url:    "X-Original-URL",
+	},
+	// https://caddyserver.com/docs/caddyfile/directives/forward_auth
+	"caddy": {
+		method: "X-Forwarded-Method",
+		proto:  "X-Forwarded-Proto",
+		host:   "X-Forwarded-Host",
+		uri:    "X-Forwarded-Uri",
+	},
+}
+
+// TrustedProxyConfig configures the proxies which send auth requests on behalf of users,
+// the original request is rebuilt from headers of requests from the trusted proxies.
+type TrustedProxyConfig struct {
+	// Preset is one of traefik, nginx or caddy, which selects the headers of original request.
+	Preset string `json:"preset"`
+	// CIDRs are the addresses of trusted proxies, a single IP is allowed as well.
+	CIDRs []string `json:"cidrs"`
+}
+
+// Validate checks the preset is known and the CIDRs could be parsed.
+func (c TrustedProxyConfig) Validate() error {
+	_, err := newTrustedProxies(c)
+	return err
+}
+
+type trustedProxies struct {
+	headers proxyHeaders
+	nets    []*net.IPNet
+}
+
+func newTrustedProxies(c TrustedProxyConfig) (*trustedProxies, error) {
+	if c.Preset == "" && len(c.CIDRs) == 0 {
+		return nil, nil
+	}
+
+	headers, ok := proxyPresets[c.Preset]
+	if !ok {
+		return nil, fmt.Errorf("trusted proxy: unknown preset %q", c.Preset)
+	}
+	if len(c.CIDRs) == 0 {
+		return nil, fmt.Errorf("trusted proxy: no CIDRs of %s", c.Preset)
+	}
+
+	p := &trustedProxies{headers: headers}
+	for _, cidr := range c.CIDRs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy: invalid IP %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			p.nets = append(p.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy: %v", err)
+		}
+		p.nets = append(p.nets, ipNet)
+	}
+	return p, nil
+}
+
+// trusted reports whether the request is sent by a trusted proxy.
+func (p *trustedProxies) trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler rebuilds the original request before passing it to next, so that the
+// original URL is redirected back to after login, and rules match it.
+func (p *trustedProxies) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.trusted(r) {
+			if original, ok := p.originalURL(r); ok {
+				r = r.WithContext(r.Context())
+				r.URL = original
+				r.Host = original.Host
+				r.RequestURI = original.RequestURI()
+				if method := r.Header.Get(p.headers.method); method != "" {
+					r.Method = method
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// originalURL returns the URL requested by user, it returns false if the request
+// is not an auth request forwarded by proxy.
+func (p *trustedProxies) originalURL(r *http.Request) (*url.URL, bool) {
+	if p.headers.url != "" {
+		if raw := r.Header.Get(p.headers.url); raw != "" {
+			u, err := url.Parse(raw)
+			if err == nil && u.IsAbs() && u.Host != "" {
+				return u, true
+			}
+		}
+	}
+
+	uri := r.Header.Get(p.headers.uri)
+	if uri == "" {
+		return nil, false
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil, false
+	}
+
+	u.Scheme = strings.ToLower(firstValue(r.Header.Get(p.headers.proto)))
+	if u.Scheme != "http" && u.Scheme != "https" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	u.Host = firstValue(r.Header.Get(p.headers.host))
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	return u, true
+}
+
+// firstValue returns the first of comma separated values, which is set by the
+// proxy closest to user.
+func firstValue(v string) string {
+	if i := strings.Index(v, ","); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewTrustedProxies(t *testing.T) {
+	tests := []struct {
+		config  TrustedProxyConfig
+		wantErr bool
+		// trusted and untrusted remote addresses
+		trusted   []string
+		untrusted []string
+	}{
+		{
+			config: TrustedProxyConfig{Preset: "traefik", CIDRs: []string{"10.0.0.0/8", "192.168.1.2", "::1", "fd00::/8"}},
+			trusted: []string{
+				"10.1.2.3:1234", "192.168.1.2:80", "192.168.1.2", "[::1]:80", "[fd00::1]:80",
+			},
+			untrusted: []string{
+				"11.0.0.1:1234", "192.168.1.3:80", "[::2]:80", "unix", "",
+			},
+		},
+		{config: TrustedProxyConfig{Preset: "nginx", CIDRs: []string{"::ffff:10.0.0.1"}}, trusted: []string{"10.0.0.1:80"}},
+		{config: TrustedProxyConfig{Preset: "apache", CIDRs: []string{"10.0.0.0/8"}}, wantErr: true},
+		{config: TrustedProxyConfig{Preset: "caddy"}, wantErr: true},
+		{config: TrustedProxyConfig{CIDRs: []string{"10.0.0.0/8"}}, wantErr: true},
+		{config: TrustedProxyConfig{Preset: "caddy", CIDRs: []string{"10.0.0.0/33"}}, wantErr: true},
+		{config: TrustedProxyConfig{Preset: "caddy", CIDRs: []string{"10.0.0"}}, wantErr: true},
+	}
+	for _, test := range tests {
+		p, err := newTrustedProxies(test.config)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%v: expected error", test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.config, err)
+			continue
+		}
+		for _, addr := range test.trusted {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = addr
+			if !p.trusted(r) {
+				t.Errorf("%v: expected %q to be trusted", test.config, addr)
+			}
+		}
+		for _, addr := range test.untrusted {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = addr
+			if p.trusted(r) {
+				t.Errorf("%v: expected %q to be untrusted", test.config, addr)
+			}
+		}
+	}
+
+	// no preset and CIDRs disables trusted proxies
+	if p, err := newTrustedProxies(TrustedProxyConfig{}); p != nil || err != nil {
+		t.Errorf("expected no trusted proxies, got %v, %v", p, err)
+	}
+}
+
+func TestOriginalURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		preset  string
+		headers map[string]string
+		tls     bool
+		want    string
+	}{
+		{
+			name:    "traefik",
+			preset:  "traefik",
+			headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "app.com", "X-Forwarded-Uri": "/a?b=c"},
+			want:    "https://app.com/a?b=c",
+		},
+		{
+			name:    "first of forwarded values",
+			preset:  "caddy",
+			headers: map[string]string{"X-Forwarded-Proto": "HTTPS, http", "X-Forwarded-Host": "app.com, proxy.local", "X-Forwarded-Uri": "/"},
+			want:    "https://app.com/",
+		},
+		{
+			name:    "no host falls back to request host",
+			preset:  "traefik",
+			headers: map[string]string{"X-Forwarded-Uri": "/a"},
+			want:    "http://auth.local/a",
+		},
+		{
+			name:    "unknown proto falls back to TLS",
+			preset:  "traefik",
+			headers: map[string]string{"X-Forwarded-Proto": "javascript", "X-Forwarded-Uri": "/a"},
+			tls:     true,
+			want:    "https://auth.local/a",
+		},
+		{
+			name:    "nginx full URL",
+			preset:  "nginx",
+			headers: map[string]string{"X-Original-URL": "https://app.com/a?b=c", "X-Original-URI": "/other"},
+			want:    "https://app.com/a?b=c",
+		},
+		{
+			name:    "nginx relative URL falls back to URI",
+			preset:  "nginx",
+			headers: map[string]string{"X-Original-URL": "/a", "X-Original-URI": "/b", "X-Forwarded-Host": "app.com"},
+			want:    "http://app.com/b",
+		},
+		{
+			name:    "no URI",
+			preset:  "traefik",
+			headers: map[string]string{"X-Forwarded-Host": "app.com"},
+		},
+		{
+			name:    "invalid URI",
+			preset:  "traefik",
+			headers: map[string]string{"X-Forwarded-Uri": "a/b"},
+		},
+	}
+	for _, test := range tests {
+		p, err := newTrustedProxies(TrustedProxyConfig{Preset: test.preset, CIDRs: []string{"10.0.0.1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "http://auth.local/auth", nil)
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+
+		u, ok := p.originalURL(r)
+		if test.want == "" {
+			if ok {
+				t.Errorf("%s: expected no original URL, got %q", test.name, u)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: expected original URL %q", test.name, test.want)
+		} else if u.String() != test.want {
+			t.Errorf("%s: expected original URL %q, got %q", test.name, test.want, u)
+		}
+	}
+}
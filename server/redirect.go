@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RedirectConfig restricts the URLs users are redirected to after login and logout,
+// so that the server can't be used as an open redirector.
+type RedirectConfig struct {
+	// AllowedHosts is a list of host patterns, a leading "*." matches any subdomain.
+	// Relative URLs and URLs of the request host are always allowed.
+	AllowedHosts []string `json:"allowedHosts"`
+	// AllowedSchemes of absolute URLs, default to https and http.
+	AllowedSchemes []string `json:"allowedSchemes"`
+	// DefaultURL is the landing URL if the redirect target is not allowed, default to "/".
+	DefaultURL string `json:"defaultURL"`
+}
+
+// Validate checks the default URL could be parsed.
+func (c RedirectConfig) Validate() error {
+	if c.DefaultURL == "" {
+		return nil
+	}
+	if _, err := url.Parse(c.DefaultURL); err != nil {
+		return fmt.Errorf("redirect: invalid default URL: %v", err)
+	}
+	return nil
+}
+
+type redirectPolicy struct {
+	hosts      []string
+	schemes    []string
+	defaultURL string
+}
+
+func newRedirectPolicy(c RedirectConfig) *redirectPolicy {
+	p := &redirectPolicy{
+		hosts:      c.AllowedHosts,
+		schemes:    c.AllowedSchemes,
+		defaultURL: c.DefaultURL,
+	}
+	if len(p.schemes) == 0 {
+		p.schemes = []string{"https", "http"}
+	}
+	if p.defaultURL == "" {
+		p.defaultURL = "/"
+	}
+	return p
+}
+
+// allowed reports whether users could be redirected to the target.
+func (p *redirectPolicy) allowed(r *http.Request, target string) bool {
+	// backslashes are treated as slashes by browsers, e.g. "/\evil.com"
+	if strings.Contains(target, "\\") {
+		return false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	if !u.IsAbs() && u.Host == "" {
+		// relative URL, protocol-relative URLs like "//evil.com" have host
+		return strings.HasPrefix(u.Path, "/") || u.Path == ""
+	}
+	if u.Host == "" {
+		return false
+	}
+
+	schemeAllowed := false
+	for _, scheme := range p.schemes {
+		if strings.EqualFold(scheme, u.Scheme) {
+			schemeAllowed = true
+			break
+		}
+	}
+	if !schemeAllowed {
+		return false
+	}
+
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, pattern := range p.hosts {
+		if matchHost(pattern, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// target returns the target if it's allowed, otherwise the default URL.
+func (p *redirectPolicy) target(r *http.Request, target string) string {
+	if target == "" {
+		return p.defaultURL
+	}
+	if !p.allowed(r, target) {
+		log.Warnf("server: reject redirect to %q, redirect to %q instead", target, p.defaultURL)
+		return p.defaultURL
+	}
+	return target
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectAllowed(t *testing.T) {
+	p := newRedirectPolicy(RedirectConfig{AllowedHosts: []string{"*.example.com", "partner.com"}})
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"", true},
+		{"/", true},
+		{"/a/b?c=d#e", true},
+		{"https://app.com/a", true},
+		{"http://APP.com/a", true},
+		{"https://www.example.com/a", true},
+		{"https://a.b.example.com/a", true},
+		{"https://partner.com:8443/a", true},
+		{"https://example.com/a", false},
+		{"https://evilexample.com/a", false},
+		{"https://www.example.com.evil.com/a", false},
+		{"https://evil.com/a", false},
+		{"//evil.com", false},
+		{"//evil.com/a", false},
+		{"/\\evil.com", false},
+		{"\\\\evil.com", false},
+		{"https:\\\\evil.com", false},
+		{"a/b", false},
+		{"javascript:alert(1)", false},
+		{"data:text/html,hi", false},
+		{"ftp://app.com/a", false},
+		{"https:evil.com", false},
+		{"%zz", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "https://app.com/auth", nil)
+		if got := p.allowed(r, test.target); got != test.want {
+			t.Errorf("allowed(%q): expected %v, got %v", test.target, test.want, got)
+		}
+	}
+
+	// only the allowed schemes
+	p = newRedirectPolicy(RedirectConfig{AllowedSchemes: []string{"https"}})
+	r := httptest.NewRequest("GET", "https://app.com/auth", nil)
+	if p.allowed(r, "http://app.com/a") {
+		t.Error("expected http to be disallowed")
+	}
+	if !p.allowed(r, "HTTPS://app.com/a") {
+		t.Error("expected https to be allowed")
+	}
+}
+
+func TestRedirectTarget(t *testing.T) {
+	p := newRedirectPolicy(RedirectConfig{DefaultURL: "https://app.com/home"})
+	r := httptest.NewRequest("GET", "https://app.com/auth", nil)
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"", "https://app.com/home"},
+		{"/a", "/a"},
+		{"//evil.com", "https://app.com/home"},
+	}
+	for _, test := range tests {
+		if got := p.target(r, test.target); got != test.want {
+			t.Errorf("target(%q): expected %q, got %q", test.target, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Action is the action taken on requests which match a Rule.
+type Action string
+
+const (
+	// ActionPublic lets requests pass without login.
+	ActionPublic Action = "public"
+	// ActionAuthenticated requires user to login, it's the default action.
+	ActionAuthenticated Action = "authenticated"
+	// ActionDeny rejects requests.
+	ActionDeny Action = "deny"
+)
+
+// ForwardToken is the token forwarded to upstream in auth responses.
+type ForwardToken string
+
+const (
+	// ForwardNone forwards no token, it's the default.
+	ForwardNone ForwardToken = ""
+	// ForwardAccessToken sets the access token in Authorization header as bearer token,
+	// the access token must be stored in session by provider.
+	ForwardAccessToken ForwardToken = "access_token"
+	// ForwardIDToken sets the ID token in X-Id-Token header.
+	ForwardIDToken ForwardToken = "id_token"
+)
+
+// Rule is an access rule evaluated before session lookup. A request matches the
+// rule if it matches any of the path prefixes or regexes, any of the methods
+// and any of the hosts, an empty list matches all requests.
+type Rule struct {
+	// Paths is a list of path prefixes, which match whole path segments of the cleaned path.
+	Paths []string `json:"paths"`
+	// PathRegexes is a list of regular expressions matching the whole cleaned path.
+	PathRegexes []string `json:"pathRegexes"`
+	// Methods is a list of HTTP methods.
+	Methods []string `json:"methods"`
+	// Hosts is a list of host patterns, a leading "*." matches any subdomain.
+	Hosts []string `json:"hosts"`
+	// Action is one of public, authenticated or deny, default to authenticated.
+	Action Action `json:"action"`
+
+	// The following authorization policies only apply to authenticated action,
+	// all of the given policies must be satisfied.
+
+	// AnyGroups requires user to be a member of at least one of the groups.
+	AnyGroups []string `json:"anyGroups"`
+	// AllGroups requires user to be a member of all the groups.
+	AllGroups []string `json:"allGroups"`
+	// Claims requires each of the ID token claims to match one of the values,
+	// e.g. {"email_verified": ["true"], "hd": ["example.com"]}.
+	Claims map[string][]string `json:"claims"`
+	// Expression is a CEL expression which must evaluate to true, e.g.
+	// "'admins' in groups || (claims.email.endsWith('@corp.com') && path.startsWith('/reports'))".
+	// Variables are claims, user, groups, method, host, path, headers and session_age.
+	Expression string `json:"expression"`
+	// ForwardToken is one of access_token or id_token, the token is set in
+	// response headers of authorized requests, so that it reaches upstream.
+	ForwardToken ForwardToken `json:"forwardToken"`
+}
+
+type rule struct {
+	Rule
+
+	pathRegexes []*regexp.Regexp
+	program     cel.Program
+}
+
+// rules is a list of compiled rules, the first matched rule wins.
+type rules []*rule
+
+// ValidateRules checks the rules could be compiled.
+func ValidateRules(rules []Rule) error {
+	_, err := compileRules(rules)
+	return err
+}
+
+func compileRules(rs []Rule) (rules, error) {
+	compiled := make(rules, 0, len(rs))
+	for i, r := range rs {
+		switch r.Action {
+		case "":
+			r.Action = ActionAuthenticated
+		case ActionPublic, ActionAuthenticated, ActionDeny:
+		default:
+			return nil, fmt.Errorf("rule %d: unknown action %q", i, r.Action)
+		}
+
+		if r.Action != ActionAuthenticated && r.hasPolicy() {
+			return nil, fmt.Errorf("rule %d: authorization policies require %s action", i, ActionAuthenticated)
+		}
+
+		switch r.ForwardToken {
+		case ForwardNone:
+		case ForwardAccessToken, ForwardIDToken:
+			if r.Action != ActionAuthenticated {
+				return nil, fmt.Errorf("rule %d: token forwarding requires %s action", i, ActionAuthenticated)
+			}
+		default:
+			return nil, fmt.Errorf("rule %d: unknown token to forward %q", i, r.ForwardToken)
+		}
+
+		c := &rule{Rule: r}
+		for _, expr := range r.PathRegexes {
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid path regex %q: %v", i, expr, err)
+			}
+			c.pathRegexes = append(c.pathRegexes, re)
+		}
+		if r.Expression != "" {
+			prg, err := compileExpression(r.Expression)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid expression %q: %v", i, r.Expression, err)
+			}
+			c.program = prg
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// match returns the first rule matching the request, or nil if there's none.
+func (rs rules) match(r *http.Request) *rule {
+	for _, rule := range rs {
+		if rule.match(r) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *rule) match(req *http.Request) bool {
+	return r.matchPath(req.URL.Path) && r.matchMethod(req.Method) && r.matchHost(req.Host)
+}
+
+func (r *rule) matchPath(p string) bool {
+	if len(r.Paths) == 0 && len(r.pathRegexes) == 0 {
+		return true
+	}
+	p = cleanPath(p)
+	for _, prefix := range r.Paths {
+		if matchPathPrefix(prefix, p) {
+			return true
+		}
+	}
+	for _, re := range r.pathRegexes {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath resolves dot segments and duplicate slashes of the request path, so
+// that "/public/../admin" and "//admin" are matched as "/admin". A trailing slash
+// is kept.
+func cleanPath(p string) string {
+	if p == "" || p[0] != '/' {
+		p = "/" + p
+	}
+	cleaned := path.Clean(p)
+	if p[len(p)-1] == '/' && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// matchPathPrefix reports whether the cleaned path is the prefix or under it, the
+// prefix only matches whole segments, e.g. "/admin" doesn't match "/administrator".
+func matchPathPrefix(prefix, p string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+func (r *rule) matchMethod(method string) bool {
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchHost(host string) bool {
+	if len(r.Hosts) == 0 {
+		return true
+	}
+	for _, pattern := range r.Hosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost reports whether host matches the pattern, port of the host is ignored.
+// A pattern with leading "*." matches any subdomain, but not the domain itself.
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	pattern = strings.ToLower(pattern)
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
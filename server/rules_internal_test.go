@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRuleMatch(t *testing.T) {
+	rs, err := compileRules([]Rule{
+		{Paths: []string{"/admin"}, Action: ActionDeny},
+		{Paths: []string{"/public/"}, Action: ActionPublic},
+		{PathRegexes: []string{`/static/.*\.css`}, Action: ActionPublic},
+		{Paths: []string{"/api/"}, Methods: []string{"POST"}, Hosts: []string{"*.example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		want   *rule
+	}{
+		{"GET", "http://app.com/admin", rs[0]},
+		{"GET", "http://app.com/admin/users", rs[0]},
+		{"GET", "http://app.com//admin", rs[0]},
+		{"GET", "http://app.com/public/../admin", rs[0]},
+		{"GET", "http://app.com/public/%2e%2e/admin", rs[0]},
+		{"GET", "http://app.com/./admin/", rs[0]},
+		{"GET", "http://app.com/administrator", nil},
+		{"GET", "http://app.com/public", rs[1]},
+		{"GET", "http://app.com/public/index.html", rs[1]},
+		{"GET", "http://app.com/publicity", nil},
+		{"GET", "http://app.com/public/../private", nil},
+		{"GET", "http://app.com/static/site.css", rs[2]},
+		{"GET", "http://app.com/static/../admin/site.css", rs[0]},
+		{"GET", "http://app.com/static/css/../../secret.css", nil},
+		{"POST", "http://www.example.com/api/users", rs[3]},
+		{"GET", "http://www.example.com/api/users", nil},
+		{"POST", "http://example.com/api/users", nil},
+		{"POST", "http://www.example.com:8080/api/", rs[3]},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		if got := rs.match(r); got != test.want {
+			t.Errorf("%s %s: expected rule %v, got %v", test.method, test.url, test.want, got)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"admin", "/admin"},
+		{"//admin", "/admin"},
+		{"/a/../b/", "/b/"},
+		{"/a/./b//c", "/a/b/c"},
+		{"/../..", "/"},
+	}
+	for _, test := range tests {
+		if got := cleanPath(test.path); got != test.want {
+			t.Errorf("cleanPath(%q): expected %q, got %q", test.path, test.want, got)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"app.example.com", "app.example.com", true},
+		{"app.example.com", "APP.example.com:443", true},
+		{"app.example.com", "app.example.com.evil.com", false},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "evilexample.com", false},
+	}
+	for _, test := range tests {
+		if got := matchHost(test.pattern, test.host); got != test.want {
+			t.Errorf("matchHost(%q, %q): expected %v, got %v", test.pattern, test.host, test.want, got)
+		}
+	}
+}
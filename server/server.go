@@ -2,57 +2,71 @@ package server
 
 import (
 	"context"
-	"fmt"
 	"net/http"
-	"net/url"
 	"path"
 
-	"github.com/coreos/go-oidc"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/pkg/errors"
-	"golang.org/x/oauth2"
 )
 
 type Config struct {
-	// Dex server address, Optional.
-	DexAddress string
-	// URL of the OpenID Connect issuer
-	IssuerURL string
-	// callback url for OpenID Connect Provider response.
-	RedirectURL string
-	// OAuth2 client ID of this application
-	ClientID string
-	// OAuth2 client secret of this application
-	ClientSecret string
-	// Scope specifies optional requested permissions
-	Scopes []string
-	// UsernameClaim is the JWT field to use as the user's username.
-	UsernameClaim string
-	// GroupsClaim, if specified, causes the OIDCAuthenticator to try to populate the user's
-	// groups with an ID Token field. If the GroupsClaim field is present in an ID Token the value
-	// must be a string or list of strings.
-	GroupsClaim string
+	// OpenID Connect providers users can login with, the first one is the default provider.
+	Providers []ProviderConfig
 	// backend session store
 	Store sessions.Store
-	// CORS allowed origins
+	// CORS allowed origins, credentialed requests to userinfo are allowed from
+	// the origins unless "*" is one of them.
 	AllowedOrigins []string
-	// Whether to use AccessTypeOffline or not
-	OfflineAccess bool
+	// Rules are access rules of requests, evaluated in order before session lookup.
+	Rules []Rule
+	// Bearer configures validation of bearer tokens in auth requests.
+	Bearer BearerConfig
+	// Headers maps response header names to Go templates over the claims of
+	// verified tokens, e.g. {"X-Email": "{{ lower .email }}"}.
+	Headers map[string]string
+	// Assertion configures the signed JWT asserting user identity to upstreams.
+	Assertion AssertionConfig
+	// Cookie customizes the session cookie.
+	Cookie CookieConfig
+	// Redirect restricts the URLs users are redirected to after login and logout.
+	Redirect RedirectConfig
+	// SessionInfo configures the session introspection endpoint.
+	SessionInfo SessionInfoConfig
+	// API configures the 401 responses to unauthenticated API requests.
+	API APIConfig
+	// SessionLimit limits the concurrent sessions of a user, virtual hosts
+	// share the limit of the default config.
+	SessionLimit SessionLimitConfig
+	// TrustedProxy configures proxies whose headers of the original request are trusted.
+	TrustedProxy TrustedProxyConfig
+	// VirtualHosts are tenants selected by request host, this config is
+	// the default one for requests which match no virtual host.
+	VirtualHosts []VirtualHost
 }
 
 type Server struct {
-	provider     *oidc.Provider
-	store        sessions.Store
-	oauth2Config *oauth2.Config
-
-	usernameClaim string
-	groupsClaim   string
-	offlineAccess bool
-	authCodeOpts  []oauth2.AuthCodeOption
+	providers []*provider
+	store     sessions.Store
+	rules     rules
+	bearer    BearerConfig
+	cookie    CookieConfig
+	asserter  *asserter
+	redirects *redirectPolicy
+	api       APIConfig
+
+	sessionInfo  SessionInfoConfig
+	sessionLimit SessionLimitConfig
+
+	// rootPath is the directory of the default provider's RedirectURL,
+	// which handlers of this server are registered under.
+	rootPath string
 
 	mux http.Handler
+	// handler is mux without the trusted proxies, which serves requests
+	// rebuilt by other protocols than forwarded HTTP.
+	handler http.Handler
 }
 
 type UserIDOpts struct {
@@ -63,62 +77,122 @@ type UserIDOpts struct {
 }
 
 func NewServer(config Config) (*Server, error) {
-	// Get callback, and root direct path from config.RedirectURL
-	url, err := url.Parse(config.RedirectURL)
+	if len(config.Providers) == 0 {
+		return nil, errors.New("server: no oidc provider")
+	}
+
+	rules, err := compileRules(config.Rules)
 	if err != nil {
-		return nil, fmt.Errorf("server: can't parse redirect URL %q", config.RedirectURL)
+		return nil, errors.Errorf("server: invalid rules: %v", err)
 	}
-	callback := path.Base(url.Path)
-	dir := path.Dir(url.Path)
 
-	client := http.DefaultClient
-	if config.DexAddress != "" {
-		client.Transport = NewDexRewriteURLRoundTripper(config.DexAddress, http.DefaultTransport)
+	if err := config.Bearer.Validate(); err != nil {
+		return nil, errors.Errorf("server: %v", err)
 	}
-	ctx := oidc.ClientContext(context.Background(), client)
-	provider, err := oidc.NewProvider(ctx, config.IssuerURL)
+
+	headers, err := compileHeaders(config.Headers)
 	if err != nil {
-		return nil, errors.Errorf("server: can't get oidc provider %q: %v", config.IssuerURL, err)
+		return nil, errors.Errorf("server: invalid headers: %v", err)
 	}
 
-	// This is the only mandatory scope and will return a sub claim
-	// which represents a unique identifier for the authenticated user.
-	oidcScopes := append(config.Scopes, oidc.ScopeOpenID)
+	if err := config.Assertion.Validate(); err != nil {
+		return nil, errors.Errorf("server: %v", err)
+	}
+
+	if err := config.Redirect.Validate(); err != nil {
+		return nil, errors.Errorf("server: %v", err)
+	}
+
+	if err := config.API.Validate(); err != nil {
+		return nil, errors.Errorf("server: %v", err)
+	}
+
+	if err := config.SessionLimit.Validate(); err != nil {
+		return nil, errors.Errorf("server: %v", err)
+	}
+
+	if _, ok := config.Store.(SessionLimiter); config.SessionLimit.MaxSessions > 0 && !ok {
+		return nil, errors.New("server: session limit is not supported by session storage")
+	}
 
 	s := &Server{
-		provider: provider,
-		oauth2Config: &oauth2.Config{
-			RedirectURL:  config.RedirectURL,
-			ClientID:     config.ClientID,
-			ClientSecret: config.ClientSecret,
-			Endpoint:     provider.Endpoint(),
-			Scopes:       oidcScopes,
-		},
-		store:         config.Store,
-		usernameClaim: config.UsernameClaim,
-		groupsClaim:   config.GroupsClaim,
-		offlineAccess: config.OfflineAccess,
+		store:  config.Store,
+		rules:  rules,
+		bearer: config.Bearer,
+		cookie: config.Cookie,
+
+		redirects: newRedirectPolicy(config.Redirect),
+		api:       config.API,
+
+		sessionInfo:  config.SessionInfo,
+		sessionLimit: config.SessionLimit,
+	}
+	if s.cookie.Name == "" {
+		s.cookie.Name = defaultSessionName
+	}
+	if config.Assertion.Enabled() {
+		if s.asserter, err = newAsserter(config.Assertion); err != nil {
+			return nil, errors.Errorf("server: %v", err)
+		}
 	}
 
+	names := make(map[string]bool)
+	offlineAccess := false
+	for _, pc := range config.Providers {
+		if len(config.Providers) > 1 {
+			if pc.Name == "" {
+				return nil, errors.New("server: name is required for multiple providers")
+			}
+			if names[pc.Name] {
+				return nil, errors.Errorf("server: duplicate provider name %q", pc.Name)
+			}
+			names[pc.Name] = true
+		}
+
+		p, err := newProvider(pc, config.Bearer)
+		if err != nil {
+			return nil, errors.Errorf("server: provider %q: %v", pc.Name, err)
+		}
+		p.headers = headers
+		s.providers = append(s.providers, p)
+		offlineAccess = offlineAccess || pc.OfflineAccess
+	}
+	dir := s.defaultProvider().callbackDir()
+	s.rootPath = dir
+
 	router := mux.NewRouter()
 	handleWithMethodGet := func(p string, f func(http.ResponseWriter,
 		*http.Request)) {
 		router.HandleFunc(path.Join(dir, p), f).Methods(http.MethodGet)
 	}
 
-	// Authorization redirect callback from OAuth2 auth flow.
-	handleWithMethodGet(callback, s.callback)
+	// Authorization redirect callback from OAuth2 auth flow, providers may share a callback.
+	callbacks := make(map[string]bool)
+	for _, p := range s.providers {
+		if !callbacks[p.callbackPath] {
+			callbacks[p.callbackPath] = true
+			router.HandleFunc(p.callbackPath, s.callback).Methods(http.MethodGet)
+		}
+	}
+	handleWithMethodGet("login", s.loginChooser)
 	handleWithMethodGet("logout", s.logout)
+	router.HandleFunc(path.Join(dir, "backchannel_logout"), s.backChannelLogout).Methods(http.MethodPost)
+	handleWithMethodGet("frontchannel_logout", s.frontChannelLogout)
+	handleWithMethodGet("userinfo", s.userInfo)
 
-	if config.OfflineAccess {
-		s.authCodeOpts = append(s.authCodeOpts, oauth2.AccessTypeOffline)
+	if offlineAccess {
 		// TODO: review refresh_token api
-		handleWithMethodGet("refresh_token", bearerTokenHandler(s.refreshToken))
+		handleWithMethodGet("refresh_token", bearerTokenHandler(s.cookie.Name, s.refreshToken))
 	}
 
 	// Handle health check
 	router.Handle("/healthz", s.healthCheck(context.Background()))
 
+	// Public keys to verify assertions issued by this server
+	if s.asserter != nil {
+		router.HandleFunc("/.well-known/jwks.json", s.asserter.jwksHandler).Methods(http.MethodGet)
+	}
+
 	// Avoid root path being required twice from web browser
 	router.HandleFunc("/favicon.ico", func(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(http.StatusNoContent)
@@ -129,13 +203,49 @@ func NewServer(config Config) (*Server, error) {
 
 	s.mux = router
 	if len(config.AllowedOrigins) > 0 {
-		corsOption := handlers.AllowedOrigins(config.AllowedOrigins)
-		s.mux = handlers.CORS(corsOption)(router)
+		s.mux = corsHandler(config.AllowedOrigins, path.Join(dir, "userinfo"), router)
+	}
+
+	if len(config.VirtualHosts) > 0 {
+		if s.mux, err = newVirtualHostRouter(config, s.mux); err != nil {
+			return nil, err
+		}
+	}
+
+	s.handler = s.mux
+
+	// Original request is rebuilt before dispatching to virtual hosts
+	proxies, err := newTrustedProxies(config.TrustedProxy)
+	if err != nil {
+		return nil, errors.Errorf("server: %v", err)
+	}
+	if proxies != nil {
+		s.mux = proxies.handler(s.mux)
 	}
 
 	return s, nil
 }
 
+// corsHandler allows CORS requests from the origins, credentials are only allowed
+// for the session cookie sent to userinfo, and never if any origin is allowed by "*".
+func corsHandler(origins []string, userInfoPath string, next http.Handler) http.Handler {
+	cors := handlers.CORS(handlers.AllowedOrigins(origins))(next)
+	for _, origin := range origins {
+		if origin == "*" {
+			return cors
+		}
+	}
+
+	credentialed := handlers.CORS(handlers.AllowedOrigins(origins), handlers.AllowCredentials())(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == userInfoPath {
+			credentialed.ServeHTTP(w, r)
+			return
+		}
+		cors.ServeHTTP(w, r)
+	})
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
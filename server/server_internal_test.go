@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSCredentials(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	origins := []string{"https://app.com"}
+	wildcard := []string{"https://app.com", "*"}
+
+	tests := []struct {
+		origins     []string
+		path        string
+		origin      string
+		wantOrigin  string
+		credentials bool
+	}{
+		{origins, "/auth/userinfo", "https://app.com", "https://app.com", true},
+		{origins, "/auth/userinfo", "https://evil.com", "", false},
+		{origins, "/auth/logout", "https://app.com", "https://app.com", false},
+		{origins, "/", "https://app.com", "https://app.com", false},
+		// any origin is allowed without credentials
+		{wildcard, "/auth/userinfo", "https://app.com", "*", false},
+		{wildcard, "/auth/userinfo", "https://evil.com", "*", false},
+		{wildcard, "/", "https://evil.com", "*", false},
+	}
+	for _, test := range tests {
+		h := corsHandler(test.origins, "/auth/userinfo", next)
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		r.Header.Set("Origin", test.origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.wantOrigin {
+			t.Errorf("%s from %s: expected allowed origin %q, got %q", test.path, test.origin, test.wantOrigin, got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != test.credentials {
+			t.Errorf("%s from %s: expected credentials %v, got %v", test.path, test.origin, test.credentials, got)
+		}
+	}
+}
@@ -26,11 +26,13 @@ func setup() error {
 	store := memory.New()
 
 	config := server.Config{
-		IssuerURL:    "http://127.0.0.1:5556/dex",
-		RedirectURL:  "http://127.0.0.1:8080/callback",
-		ClientID:     "auth-service",
-		ClientSecret: "ZXhhbXBsZS1hcHAtc2VjcmV0",
-		Store:        store,
+		Providers: []server.ProviderConfig{{
+			IssuerURL:    "http://127.0.0.1:5556/dex",
+			RedirectURL:  "http://127.0.0.1:8080/callback",
+			ClientID:     "auth-service",
+			ClientSecret: "ZXhhbXBsZS1hcHAtc2VjcmV0",
+		}},
+		Store: store,
 	}
 
 	var err error
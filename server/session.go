@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// refreshSkew is how long before ID token expiry the session is refreshed.
+const refreshSkew = time.Minute
+
+var (
+	errNoRefreshToken = errors.New("no refresh token in session")
+	errSessionExpired = errors.New("ID token in session is expired")
+)
+
+// authSession returns the session of the logged in user, with cookie options of the server.
+func (s *Server) authSession(r *http.Request) (*sessions.Session, error) {
+	session, err := s.store.Get(r, s.cookie.Name)
+	if session == nil {
+		return nil, err
+	}
+
+	if s.cookie.Domain != "" {
+		session.Options.Domain = s.cookie.Domain
+	}
+	if s.cookie.Secure {
+		session.Options.Secure = true
+	}
+	return session, err
+}
+
+// updateSession verifies the ID token, and saves the identity extracted from it into
+// session values. The nonce claim of the ID token must match the given nonce unless
+// it's empty. The access token is used to fetch UserInfo claims if the provider is
+// configured to. The session itself is not saved.
+func (p *provider) updateSession(ctx context.Context, token, accessToken, nonce string, session *sessions.Session) error {
+	verifier := p.oidc.Verifier(&oidc.Config{ClientID: p.oauth2Config.ClientID})
+	idToken, err := verifier.Verify(ctx, token)
+	if err != nil {
+		return fmt.Errorf("verify token: %v", err)
+	}
+
+	if nonce != "" && idToken.Nonce != nonce {
+		return errors.New("verify token: nonce mismatch")
+	}
+
+	var rawClaims json.RawMessage
+	if err := idToken.Claims(&rawClaims); err != nil {
+		return fmt.Errorf("parse oidc claims: %v", err)
+	}
+	var c claims
+	if err := json.Unmarshal(rawClaims, &c); err != nil {
+		return fmt.Errorf("parse oidc claims: %v", err)
+	}
+	c, rawClaims, err = p.enrichClaims(ctx, c, rawClaims, accessToken, idToken.Subject)
+	if err != nil {
+		return err
+	}
+
+	id, err := p.identityFromClaims(c)
+	if err != nil {
+		return err
+	}
+
+	session.Values["user_name"] = id.username
+	// provider, issuer and client_id tell which provider verifies and refreshes
+	// the session, and bind the session to the tenant of the provider
+	session.Values["provider"] = p.name
+	session.Values["issuer"] = p.issuerURL
+	session.Values["client_id"] = p.oauth2Config.ClientID
+	// sub and sid identify sessions to be revoked by provider
+	session.Values["sub"] = idToken.Subject
+	var sid string
+	if err := c.unmarshalClaim("sid", &sid); err == nil {
+		session.Values["sid"] = sid
+	}
+	if len(p.groupsClaim) > 0 {
+		session.Values["user_groups"] = id.groups
+	}
+	// headers are rendered at login, so that they're not rendered for each request
+	if len(id.headers) > 0 {
+		session.Values["headers"] = id.headers
+	} else {
+		delete(session.Values, "headers")
+	}
+	// claims are kept for authorization of later requests
+	session.Values["claims"] = string(rawClaims)
+	if _, ok := session.Values["created_at"]; !ok {
+		session.Values["created_at"] = time.Now().Unix()
+	}
+	session.Values["expiry"] = idToken.Expiry.Unix()
+	session.Values["id_token"] = token
+	return nil
+}
+
+// refreshSession gets new tokens with the refresh token in session, then
+// re-verifies the ID token and updates the session values.
+func (p *provider) refreshSession(ctx context.Context, session *sessions.Session) error {
+	refresh, ok := session.Values["refresh-token"].(string)
+	if !ok || refresh == "" {
+		return errNoRefreshToken
+	}
+
+	t := &oauth2.Token{
+		RefreshToken: refresh,
+		Expiry:       time.Now().Add(-time.Hour),
+	}
+	oauth2Token, err := p.oauth2Config.TokenSource(ctx, t).Token()
+	if err != nil {
+		return fmt.Errorf("refresh token: %v", err)
+	}
+
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		return errors.New("no id_token in token response")
+	}
+	if err := p.updateSession(ctx, rawIDToken, oauth2Token.AccessToken, "", session); err != nil {
+		return err
+	}
+
+	// refresh token may be rotated
+	if oauth2Token.RefreshToken != "" {
+		session.Values["refresh-token"] = oauth2Token.RefreshToken
+	}
+	if p.storeAccessToken {
+		session.Values["access_token"] = oauth2Token.AccessToken
+	}
+	return nil
+}
+
+// ensureFresh checks the ID token expiry of the session, and refreshes the session
+// if the ID token is near or past expiry and offline access is enabled. It returns
+// true if the session has been refreshed and must be saved, or an error if the session
+// can't be used anymore. A session failed to refresh is kept until its ID token expires.
+func (s *Server) ensureFresh(r *http.Request, p *provider, session *sessions.Session) (bool, error) {
+	expiry, ok := session.Values["expiry"].(int64)
+	if !ok {
+		// session is created by a previous version without expiry
+		return false, nil
+	}
+
+	now := time.Now()
+	exp := time.Unix(expiry, 0)
+	if now.Add(refreshSkew).Before(exp) {
+		return false, nil
+	}
+
+	if p.offlineAccess {
+		if refresh, _ := session.Values["refresh-token"].(string); refresh != "" {
+			err := s.refreshSession(r, p, session)
+			if err == nil {
+				return true, nil
+			}
+			if now.Before(exp) {
+				log.Warnf("server: refresh session: %s", err)
+				return false, nil
+			}
+			return false, err
+		}
+	}
+
+	if now.Before(exp) {
+		return false, nil
+	}
+	return false, errSessionExpired
+}
+
+// refreshSession refreshes the session by the provider. Refreshes of a session are
+// serialized, since the refresh token may be rotated by the first one, the session
+// is reloaded from the store and taken as is if it's refreshed while waiting.
+func (s *Server) refreshSession(r *http.Request, p *provider, session *sessions.Session) error {
+	key := session.ID
+	if key == "" {
+		// sessions of cookie store have no ID
+		key, _ = session.Values["refresh-token"].(string)
+	}
+
+	values, err := p.refreshes.do(key, func() (map[interface{}]interface{}, error) {
+		latest, err := s.store.New(r, session.Name())
+		if err == nil && !latest.IsNew {
+			expiry, _ := session.Values["expiry"].(int64)
+			if latestExpiry, _ := latest.Values["expiry"].(int64); latestExpiry > expiry {
+				return latest.Values, nil
+			}
+		}
+
+		refreshed := sessions.NewSession(session.Store(), session.Name())
+		for k, v := range session.Values {
+			refreshed.Values[k] = v
+		}
+		if err := p.refreshSession(r.Context(), refreshed); err != nil {
+			return nil, err
+		}
+		return refreshed.Values, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// values are shared by the waiting requests
+	session.Values = make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	return nil
+}
+
+// refreshGroup serializes refreshes of the same session, callers wait for the
+// refresh in progress and share its result.
+type refreshGroup struct {
+	mu    sync.Mutex
+	calls map[string]*refreshCall
+}
+
+type refreshCall struct {
+	done   chan struct{}
+	values map[interface{}]interface{}
+	err    error
+}
+
+func (g *refreshGroup) do(key string, fn func() (map[interface{}]interface{}, error)) (map[interface{}]interface{}, error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.values, c.err
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*refreshCall)
+	}
+	c := &refreshCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.values, c.err = fn()
+	close(c.done)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return c.values, c.err
+}
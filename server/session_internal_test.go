@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+
+	"github.com/fezho/oidc-auth/storage/memory"
+)
+
+func newRefreshTestServer(t *testing.T, idp *testIdP) (*Server, *provider) {
+	config := idp.config("")
+	config.OfflineAccess = true
+	p, err := newProvider(config, BearerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		store:     memory.New(),
+		cookie:    CookieConfig{Name: defaultSessionName},
+		providers: []*provider{p},
+	}
+	return s, p
+}
+
+// loggedInSession saves a session refreshed by "rt" with the ID token expiry,
+// then returns a request of its cookie and the session loaded by the request.
+func loggedInSession(t *testing.T, s *Server, p *provider, expiry time.Time) (*http.Request, *sessions.Session) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := s.authSession(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["user_name"] = "tom"
+	session.Values["provider"] = p.name
+	session.Values["issuer"] = p.issuerURL
+	session.Values["client_id"] = p.oauth2Config.ClientID
+	session.Values["refresh-token"] = "rt"
+	session.Values["expiry"] = expiry.Unix()
+	w := httptest.NewRecorder()
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if session, err = s.authSession(r); err != nil {
+		t.Fatal(err)
+	}
+	return r, session
+}
+
+// refreshResponse answers refresh requests of "rt" with rotated refresh token "rt2".
+func refreshResponse(idToken string) func(form url.Values) interface{} {
+	return func(form url.Values) interface{} {
+		if form.Get("grant_type") != "refresh_token" || form.Get("refresh_token") != "rt" {
+			return nil
+		}
+		return map[string]interface{}{
+			"access_token":  "at",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"refresh_token": "rt2",
+			"id_token":      idToken,
+		}
+	}
+}
+
+func TestEnsureFresh(t *testing.T) {
+	tests := []struct {
+		name          string
+		expiry        time.Duration
+		refreshFails  bool
+		wantRefreshed bool
+		wantErr       bool
+		// wantRequest is whether the token endpoint is requested
+		wantRequest bool
+	}{
+		{"fresh", time.Hour, false, false, false, false},
+		{"within skew", refreshSkew / 2, false, true, false, true},
+		{"expired", -time.Minute, false, true, false, true},
+		{"refresh fails within skew", refreshSkew / 2, true, false, false, true},
+		{"refresh fails after expiry", -time.Minute, true, false, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			idp := newTestIdP(t)
+			defer idp.Close()
+			if !test.refreshFails {
+				idp.token = refreshResponse(idp.idToken(t, nil))
+			}
+			s, p := newRefreshTestServer(t, idp)
+			r, session := loggedInSession(t, s, p, time.Now().Add(test.expiry))
+
+			refreshed, err := s.ensureFresh(r, p, session)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("expected error %v, got %v", test.wantErr, err)
+			}
+			if refreshed != test.wantRefreshed {
+				t.Errorf("expected refreshed %v, got %v", test.wantRefreshed, refreshed)
+			}
+			if got := len(idp.requests()) > 0; got != test.wantRequest {
+				t.Errorf("expected token requested %v, got %v", test.wantRequest, got)
+			}
+
+			wantToken := "rt"
+			if test.wantRefreshed {
+				wantToken = "rt2"
+			}
+			if got := session.Values["refresh-token"]; got != wantToken {
+				t.Errorf("expected refresh token %q, got %q", wantToken, got)
+			}
+		})
+	}
+}
+
+func TestEnsureFreshConcurrent(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	refresh := refreshResponse(idp.idToken(t, nil))
+	idp.token = func(form url.Values) interface{} {
+		// keep the refresh in progress until all the requests are waiting
+		time.Sleep(100 * time.Millisecond)
+		return refresh(form)
+	}
+	s, p := newRefreshTestServer(t, idp)
+	r, _ := loggedInSession(t, s, p, time.Now().Add(refreshSkew/2))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := r.Clone(r.Context())
+			session, err := s.store.New(req, s.cookie.Name)
+			if err == nil {
+				_, err = s.ensureFresh(req, p, session)
+			}
+			if err == nil && session.Values["refresh-token"] != "rt2" {
+				err = fmt.Errorf("unexpected refresh token %q", session.Values["refresh-token"])
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("refresh session: %v", err)
+		}
+	}
+	if got := len(idp.requests()); got != 1 {
+		t.Errorf("expected 1 token request, got %d", got)
+	}
+}
+
+func TestEnsureFreshReloadsSession(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	s, p := newRefreshTestServer(t, idp)
+	r, session := loggedInSession(t, s, p, time.Now().Add(refreshSkew/2))
+
+	// another request has refreshed the session and rotated the refresh token
+	latest, err := s.store.New(r, s.cookie.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest.Values["refresh-token"] = "rt2"
+	latest.Values["expiry"] = time.Now().Add(time.Hour).Unix()
+	if err := latest.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := s.ensureFresh(r, p, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !refreshed {
+		t.Error("expected session to be refreshed")
+	}
+	if got := len(idp.requests()); got != 0 {
+		t.Errorf("expected no token request, got %d", got)
+	}
+	if got := session.Values["refresh-token"]; got != "rt2" {
+		t.Errorf("expected refresh token of the reloaded session, got %q", got)
+	}
+}
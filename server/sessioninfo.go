@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionInfoConfig configures the session introspection endpoint, which tells
+// front-end apps who is logged in.
+type SessionInfoConfig struct {
+	// Claims are names of the verified claims included in the response.
+	Claims []string `json:"claims"`
+	// IncludeTokens includes the raw ID token and access token in the response,
+	// which exposes them to scripts of the apps.
+	IncludeTokens bool `json:"includeTokens"`
+}
+
+// sessionInfo is the response of the session introspection endpoint.
+type sessionInfo struct {
+	User        string                 `json:"user"`
+	Groups      []string               `json:"groups,omitempty"`
+	Claims      map[string]interface{} `json:"claims,omitempty"`
+	Provider    string                 `json:"provider,omitempty"`
+	Issuer      string                 `json:"issuer,omitempty"`
+	CreatedAt   *time.Time             `json:"created_at,omitempty"`
+	ExpiresAt   *time.Time             `json:"expires_at,omitempty"`
+	Refreshable bool                   `json:"refreshable"`
+	IDToken     string                 `json:"id_token,omitempty"`
+	AccessToken string                 `json:"access_token,omitempty"`
+}
+
+// userInfo is the handler responsible for describing the session of current user.
+func (s *Server) userInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+
+	session, err := s.authSession(r)
+	if err != nil {
+		log.Errorf("server: get session: %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := session.Values["user_name"]; session.IsNew || !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthenticated"})
+		return
+	}
+
+	p, err := s.sessionProvider(session)
+	refreshed := false
+	if err == nil {
+		refreshed, err = s.ensureFresh(r, p, session)
+	}
+	if err != nil {
+		log.Infof("server: end session: %s", err)
+		deleteCookie(session, w, r)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthenticated"})
+		return
+	}
+	if refreshed {
+		if err := s.saveSession(session, w, r); err != nil {
+			log.Errorf("server: save session: %s", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	id := identityFromSession(session)
+	info := sessionInfo{
+		User:     id.username,
+		Groups:   id.groups,
+		Provider: p.name,
+		Issuer:   p.issuerURL,
+	}
+	for _, name := range s.sessionInfo.Claims {
+		val, ok := id.claims[name]
+		if !ok {
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal(val, &v); err != nil {
+			continue
+		}
+		if info.Claims == nil {
+			info.Claims = make(map[string]interface{})
+		}
+		info.Claims[name] = v
+	}
+	if !id.createdAt.IsZero() {
+		info.CreatedAt = &id.createdAt
+	}
+	if expiry, ok := session.Values["expiry"].(int64); ok {
+		expiresAt := time.Unix(expiry, 0)
+		info.ExpiresAt = &expiresAt
+	}
+	refresh, _ := session.Values["refresh-token"].(string)
+	info.Refreshable = p.offlineAccess && refresh != ""
+	if s.sessionInfo.IncludeTokens {
+		info.IDToken = id.idToken
+		info.AccessToken = id.accessToken
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+// writeJSON writes the value as JSON response with the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("server: write json response: %s", err)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// Eviction decides what happens when a user logs in with the maximum sessions.
+type Eviction string
+
+const (
+	// EvictOldest ends the earliest sessions of the user, it's the default.
+	EvictOldest Eviction = "oldest"
+	// EvictRefuse refuses the new login.
+	EvictRefuse Eviction = "refuse"
+)
+
+var errTooManySessions = errors.New("too many sessions")
+
+// SessionLimitConfig limits the concurrent sessions of a user. Sessions are counted per
+// subject of the issuer atomically by session storage, which is shared by replicas with redis.
+type SessionLimitConfig struct {
+	// MaxSessions is the maximum sessions of a user, 0 means unlimited,
+	// 1 keeps a single active session per user.
+	MaxSessions int `json:"maxSessions"`
+	// Eviction is either oldest or refuse, default to oldest.
+	Eviction Eviction `json:"eviction"`
+}
+
+// Validate checks the limit and eviction.
+func (c SessionLimitConfig) Validate() error {
+	if c.MaxSessions < 0 {
+		return errors.New("session limit: maxSessions must not be negative")
+	}
+	switch c.Eviction {
+	case "", EvictOldest, EvictRefuse:
+	default:
+		return fmt.Errorf("session limit: unknown eviction %q", c.Eviction)
+	}
+	if c.MaxSessions == 0 && c.Eviction != "" {
+		return errors.New("session limit: eviction requires maxSessions")
+	}
+	return nil
+}
+
+// SessionLimiter is implemented by session stores which can limit the sessions of an index.
+type SessionLimiter interface {
+	// IndexLimited records the session in the limited index of key, which keeps at most
+	// max sessions. Sessions are counted, evicted and recorded atomically, the earliest
+	// recorded ones are deleted to make room and their ids returned, unless refuse is
+	// true, then the session is not recorded and false is returned.
+	IndexLimited(session *sessions.Session, key string, max int, refuse bool) ([]string, bool, error)
+}
+
+// limitIndexKey counts the sessions of a subject of the issuer, which is the same user
+// across providers and virtual hosts of the issuer.
+func limitIndexKey(issuer, sub string) string {
+	return indexKey("limit", issuer, sub)
+}
+
+// limitSessions makes room for the new session of user by the eviction before it's
+// saved, it returns errTooManySessions if the login is refused.
+func (s *Server) limitSessions(session *sessions.Session) error {
+	if s.sessionLimit.MaxSessions <= 0 {
+		return nil
+	}
+
+	issuer, _ := session.Values["issuer"].(string)
+	sub, _ := session.Values["sub"].(string)
+	refuse := s.sessionLimit.Eviction == EvictRefuse
+	evicted, ok, err := s.store.(SessionLimiter).IndexLimited(session, limitIndexKey(issuer, sub), s.sessionLimit.MaxSessions, refuse)
+	if err != nil {
+		return fmt.Errorf("limit sessions of %s: %v", sub, err)
+	}
+	if !ok {
+		return errTooManySessions
+	}
+	for _, id := range evicted {
+		log.Infof("server: evict session %s of %s", id, session.Values["user_name"])
+	}
+	return nil
+}
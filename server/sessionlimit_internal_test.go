@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fezho/oidc-auth/storage/memory"
+)
+
+func TestLimitSessions(t *testing.T) {
+	tests := []struct {
+		eviction Eviction
+		// issuer and sub of the last login
+		issuer, sub string
+		wantErr     error
+		wantEvicted bool
+	}{
+		{EvictOldest, "https://a.idp.com", "u1", nil, true},
+		{EvictRefuse, "https://a.idp.com", "u1", errTooManySessions, false},
+		// the same sub of another issuer is another user
+		{EvictRefuse, "https://b.idp.com", "u1", nil, false},
+		{EvictRefuse, "https://a.idp.com", "u2", nil, false},
+	}
+	for _, test := range tests {
+		s := &Server{
+			store:        memory.New(),
+			cookie:       CookieConfig{Name: defaultSessionName},
+			sessionLimit: SessionLimitConfig{MaxSessions: 2, Eviction: test.eviction},
+		}
+		login := func(issuer, sub string) (string, error) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			session, err := s.authSession(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session.Values["user_name"] = "tom"
+			session.Values["issuer"] = issuer
+			session.Values["sub"] = sub
+			if err := s.limitSessions(session); err != nil {
+				return "", err
+			}
+			return session.ID, s.saveSession(session, httptest.NewRecorder(), r)
+		}
+
+		first, err := login("https://a.idp.com", "u1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := login("https://a.idp.com", "u1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := login(test.issuer, test.sub); err != test.wantErr {
+			t.Errorf("%s login of %s %s: expected error %v, got %v", test.eviction, test.issuer, test.sub, test.wantErr, err)
+		}
+		_, ok, err := s.store.(SessionAdmin).Lookup(first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if evicted := !ok; evicted != test.wantEvicted {
+			t.Errorf("%s login of %s %s: expected first session evicted %v, got %v", test.eviction, test.issuer, test.sub, test.wantEvicted, evicted)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// loginSessionPrefix is the cookie name prefix of login transactions,
+	// the full cookie name is suffixed by the state of the transaction.
+	loginSessionPrefix = "oidc-auth.login."
+	// loginSessionMaxAge is the lifetime of a login transaction in seconds,
+	// user must finish the login at IdP within it.
+	loginSessionMaxAge = 600
+	// maxLoginTransactions is the maximum concurrent login transactions of a browser,
+	// the oldest transactions are dropped for a new one.
+	maxLoginTransactions = 5
+)
+
+// loginTransaction is a login flow started by user, which is finished by the
+// callback with its state.
+type loginTransaction struct {
+	provider     string
+	redirectTo   string
+	nonce        string
+	codeVerifier string
+	createdAt    int64
+}
+
+// loginSession returns the login transaction keyed by state. Each login flow keeps
+// its own redirect_to, nonce and code_verifier in a short-lived cookie and store
+// record, so that several flows started from different browser tabs at once don't
+// overwrite each other.
+func (s *Server) loginSession(r *http.Request, state string) (*sessions.Session, error) {
+	session, err := s.store.Get(r, loginSessionPrefix+state)
+	if err != nil {
+		return nil, err
+	}
+
+	// transactions are started at any path, and finished at callbacks
+	session.Options.Path = "/"
+	session.Options.MaxAge = loginSessionMaxAge
+	return session, nil
+}
+
+// setLoginTransaction saves the transaction into its session values.
+func setLoginTransaction(session *sessions.Session, txn loginTransaction) {
+	session.Values["provider"] = txn.provider
+	session.Values["redirect_to"] = txn.redirectTo
+	session.Values["nonce"] = txn.nonce
+	session.Values["code_verifier"] = txn.codeVerifier
+	session.Values["created_at"] = strconv.FormatInt(txn.createdAt, 10)
+}
+
+// loginTransactionOf returns the transaction in session, which is false if
+// the session is new or the transaction is expired.
+func loginTransactionOf(session *sessions.Session) (loginTransaction, bool) {
+	if session.IsNew {
+		return loginTransaction{}, false
+	}
+
+	var txn loginTransaction
+	txn.provider, _ = session.Values["provider"].(string)
+	txn.redirectTo, _ = session.Values["redirect_to"].(string)
+	txn.nonce, _ = session.Values["nonce"].(string)
+	txn.codeVerifier, _ = session.Values["code_verifier"].(string)
+	createdAt, _ := session.Values["created_at"].(string)
+	txn.createdAt, _ = strconv.ParseInt(createdAt, 10, 64)
+	if txn.createdAt <= time.Now().Unix()-loginSessionMaxAge {
+		return loginTransaction{}, false
+	}
+	return txn, true
+}
+
+// dropLoginSessions deletes cookies of the oldest login transactions, so that at
+// most maxLoginTransactions are left with a new one. Unfinished flows like assets
+// and iframes don't grow the cookies of the browser, which sends older cookies first.
+func dropLoginSessions(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	for _, c := range r.Cookies() {
+		if strings.HasPrefix(c.Name, loginSessionPrefix) {
+			names = append(names, c.Name)
+		}
+	}
+	for i := 0; i <= len(names)-maxLoginTransactions; i++ {
+		http.SetCookie(w, &http.Cookie{Name: names[i], Path: "/", MaxAge: -1})
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fezho/oidc-auth/storage/memory"
+)
+
+// jarRequest returns a request to target with cookies of the jar.
+func jarRequest(jar http.CookieJar, target string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, c := range jar.Cookies(r.URL) {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+// serveWithJar serves the request by the server, cookies of the response are
+// kept in the jar like a browser.
+func serveWithJar(s *Server, jar http.CookieJar, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	jar.SetCookies(r.URL, w.Result().Cookies())
+	return w
+}
+
+// startTestLogin requests without session, and returns the query of the
+// authorization request it's redirected to.
+func startTestLogin(t *testing.T, s *Server, jar http.CookieJar, r *http.Request) url.Values {
+	w := serveWithJar(s, jar, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("%s: expected login redirect, got code %d", r.URL, w.Code)
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query()
+}
+
+func TestLoginTransaction(t *testing.T) {
+	s := &Server{store: memory.New()}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := s.loginSession(r, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loginTransactionOf(session); ok {
+		t.Error("expected no transaction in new session")
+	}
+
+	want := loginTransaction{provider: "corp", redirectTo: "/app", nonce: "n", codeVerifier: "v", createdAt: time.Now().Unix()}
+	setLoginTransaction(session, want)
+	session.IsNew = false
+	if got, ok := loginTransactionOf(session); !ok || got != want {
+		t.Errorf("expected transaction %+v, got %+v", want, got)
+	}
+
+	setLoginTransaction(session, loginTransaction{nonce: "n", createdAt: time.Now().Unix() - loginSessionMaxAge - 1})
+	if _, ok := loginTransactionOf(session); ok {
+		t.Error("expected expired transaction to be rejected")
+	}
+}
+
+func TestDropLoginSessions(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultSessionName, Value: "v"})
+	for i := 0; i < maxLoginTransactions+1; i++ {
+		r.AddCookie(&http.Cookie{Name: fmt.Sprintf("%sstate-%d", loginSessionPrefix, i), Value: "v"})
+	}
+
+	w := httptest.NewRecorder()
+	dropLoginSessions(w, r)
+	var dropped []string
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			dropped = append(dropped, strings.TrimPrefix(c.Name, loginSessionPrefix))
+		}
+	}
+	if got := strings.Join(dropped, " "); got != "state-0 state-1" {
+		t.Errorf("expected the oldest transactions to be dropped, got %q", got)
+	}
+}
+
+func TestConcurrentLogins(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	// authorization code is the nonce of the login in this test
+	idp.token = func(form url.Values) interface{} {
+		return map[string]interface{}{
+			"access_token": "at",
+			"token_type":   "Bearer",
+			"id_token":     idp.idToken(t, map[string]interface{}{"nonce": form.Get("code")}),
+		}
+	}
+	s, err := NewServer(Config{Providers: []ProviderConfig{idp.config("")}, Store: memory.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// logins are started from two tabs at once, neither request has the
+	// cookie of the other one
+	r1, r2 := jarRequest(jar, "http://app.com/first"), jarRequest(jar, "http://app.com/second")
+	first := startTestLogin(t, s, jar, r1)
+	second := startTestLogin(t, s, jar, r2)
+	if first.Get("state") == second.Get("state") {
+		t.Fatal("expected logins of different states")
+	}
+
+	for _, test := range []struct {
+		query url.Values
+		want  string
+	}{
+		{first, "http://app.com/first"},
+		{second, "http://app.com/second"},
+	} {
+		callback := "http://app.com/oidc/callback?" + url.Values{
+			"code":  {test.query.Get("nonce")},
+			"state": {test.query.Get("state")},
+		}.Encode()
+		w := serveWithJar(s, jar, jarRequest(jar, callback))
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: expected login to complete, got code %d: %s", test.want, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Location"); got != test.want {
+			t.Errorf("expected redirect to %q, got %q", test.want, got)
+		}
+
+		// login transaction can only be used once
+		if w := serveWithJar(s, jar, jarRequest(jar, callback)); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected replayed callback to be rejected, got code %d", test.want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// UserInfoPrecedence decides which claim is kept if a claim is present in both
+// the ID token and the UserInfo response.
+type UserInfoPrecedence string
+
+const (
+	// PrecedenceIDToken keeps claims of the ID token, it's the default.
+	PrecedenceIDToken UserInfoPrecedence = "id_token"
+	// PrecedenceUserInfo overrides claims of the ID token with the UserInfo ones.
+	PrecedenceUserInfo UserInfoPrecedence = "userinfo"
+)
+
+// Validate checks the precedence is known.
+func (p UserInfoPrecedence) Validate() error {
+	switch p {
+	case "", PrecedenceIDToken, PrecedenceUserInfo:
+		return nil
+	default:
+		return fmt.Errorf("unknown userinfo precedence %q", p)
+	}
+}
+
+// idTokenClaims describe the ID token itself rather than user, they're always
+// taken from the ID token regardless of the precedence.
+var idTokenClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true,
+	"auth_time": true, "nonce": true, "acr": true, "amr": true, "azp": true,
+	"at_hash": true, "c_hash": true, "sid": true,
+}
+
+// userInfoClaims fetches the claims of user from the UserInfo endpoint with the
+// access token, the sub claim must be the subject of the ID token.
+// https://openid.net/specs/openid-connect-core-1_0.html#UserInfoResponse
+func (p *provider) userInfoClaims(ctx context.Context, accessToken, subject string) (claims, error) {
+	if accessToken == "" {
+		return nil, errors.New("userinfo: no access token")
+	}
+
+	ctx = oidc.ClientContext(ctx, p.client)
+	info, err := p.oidc.UserInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}))
+	if err != nil {
+		return nil, fmt.Errorf("userinfo: %v", err)
+	}
+	if info.Subject != subject {
+		return nil, fmt.Errorf("userinfo: subject %q doesn't match ID token subject %q", info.Subject, subject)
+	}
+
+	var c claims
+	if err := info.Claims(&c); err != nil {
+		return nil, fmt.Errorf("userinfo: parse claims: %v", err)
+	}
+	return c, nil
+}
+
+// mergeClaims adds the UserInfo claims to the ID token claims by precedence.
+func mergeClaims(idToken, userInfo claims, precedence UserInfoPrecedence) claims {
+	merged := make(claims, len(idToken)+len(userInfo))
+	for name, val := range idToken {
+		merged[name] = val
+	}
+	for name, val := range userInfo {
+		if idTokenClaims[name] {
+			continue
+		}
+		if _, ok := merged[name]; ok && precedence != PrecedenceUserInfo {
+			continue
+		}
+		merged[name] = val
+	}
+	return merged
+}
+
+// enrichClaims merges the UserInfo claims into the ID token claims if the provider
+// is configured to, and returns the merged claims in JSON as well.
+func (p *provider) enrichClaims(ctx context.Context, c claims, raw json.RawMessage, accessToken, subject string) (claims, json.RawMessage, error) {
+	if !p.userInfo {
+		return c, raw, nil
+	}
+
+	info, err := p.userInfoClaims(ctx, accessToken, subject)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged := mergeClaims(c, info, p.userInfoPrecedence)
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, fmt.Errorf("userinfo: encode claims: %v", err)
+	}
+	return merged, data, nil
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestMergeClaims(t *testing.T) {
+	idToken := claims{
+		"sub":   json.RawMessage(`"u1"`),
+		"iss":   json.RawMessage(`"https://idp.com"`),
+		"name":  json.RawMessage(`"tom"`),
+		"email": json.RawMessage(`"tom@old.com"`),
+	}
+	userInfo := claims{
+		"sub":    json.RawMessage(`"u2"`),
+		"iss":    json.RawMessage(`"https://other.com"`),
+		"email":  json.RawMessage(`"tom@new.com"`),
+		"groups": json.RawMessage(`["dev"]`),
+	}
+
+	tests := []struct {
+		name       string
+		userInfo   claims
+		precedence UserInfoPrecedence
+		want       map[string]string
+	}{
+		{
+			name:     "default precedence",
+			userInfo: userInfo,
+			want: map[string]string{
+				"sub": `"u1"`, "iss": `"https://idp.com"`, "name": `"tom"`,
+				"email": `"tom@old.com"`, "groups": `["dev"]`,
+			},
+		},
+		{
+			name:       "id token precedence",
+			userInfo:   userInfo,
+			precedence: PrecedenceIDToken,
+			want: map[string]string{
+				"sub": `"u1"`, "iss": `"https://idp.com"`, "name": `"tom"`,
+				"email": `"tom@old.com"`, "groups": `["dev"]`,
+			},
+		},
+		{
+			// claims describing the ID token are kept anyway
+			name:       "userinfo precedence",
+			userInfo:   userInfo,
+			precedence: PrecedenceUserInfo,
+			want: map[string]string{
+				"sub": `"u1"`, "iss": `"https://idp.com"`, "name": `"tom"`,
+				"email": `"tom@new.com"`, "groups": `["dev"]`,
+			},
+		},
+		{
+			name:       "no userinfo",
+			precedence: PrecedenceUserInfo,
+			want: map[string]string{
+				"sub": `"u1"`, "iss": `"https://idp.com"`, "name": `"tom"`, "email": `"tom@old.com"`,
+			},
+		},
+	}
+	for _, test := range tests {
+		merged := mergeClaims(idToken, test.userInfo, test.precedence)
+		if len(merged) != len(test.want) {
+			t.Errorf("%s: expected %d claims, got %d", test.name, len(test.want), len(merged))
+		}
+		for name, want := range test.want {
+			if got := string(merged[name]); got != want {
+				t.Errorf("%s: expected claim %s %s, got %s", test.name, name, want, got)
+			}
+		}
+	}
+	if got := string(idToken["email"]); got != `"tom@old.com"` {
+		t.Errorf("expected ID token claims unchanged, got email %s", got)
+	}
+}
+
+func TestEnrichClaims(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+
+	tests := []struct {
+		name        string
+		disabled    bool
+		accessToken string
+		// userInfo is the UserInfo response, the request fails if it's nil
+		userInfo  map[string]interface{}
+		wantEmail string
+		wantErr   bool
+	}{
+		{"disabled", true, "at", nil, "tom@old.com", false},
+		{"merged", false, "at", map[string]interface{}{"sub": "u1", "email": "tom@new.com"}, "tom@new.com", false},
+		{"subject mismatch", false, "at", map[string]interface{}{"sub": "u2", "email": "tom@new.com"}, "", true},
+		{"no subject", false, "at", map[string]interface{}{"email": "tom@new.com"}, "", true},
+		{"fetch failure", false, "at", nil, "", true},
+		{"no access token", false, "", map[string]interface{}{"sub": "u1"}, "", true},
+	}
+	for _, test := range tests {
+		var requested bool
+		idp.userInfo = func(r *http.Request) interface{} {
+			requested = true
+			if got := r.Header.Get("Authorization"); got != "Bearer "+test.accessToken {
+				t.Errorf("%s: unexpected authorization %q", test.name, got)
+			}
+			if test.userInfo == nil {
+				return nil
+			}
+			return test.userInfo
+		}
+		config := idp.config("")
+		config.UserInfo = !test.disabled
+		config.UserInfoPrecedence = PrecedenceUserInfo
+		p, err := newProvider(config, BearerConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw := json.RawMessage(`{"sub":"u1","email":"tom@old.com"}`)
+		var c claims
+		if err := json.Unmarshal(raw, &c); err != nil {
+			t.Fatal(err)
+		}
+		merged, data, err := p.enrichClaims(context.Background(), c, raw, test.accessToken, "u1")
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.wantErr, err)
+			continue
+		}
+		if test.disabled && requested {
+			t.Errorf("%s: expected UserInfo not requested", test.name)
+		}
+		if err != nil {
+			continue
+		}
+
+		var email string
+		if err := merged.unmarshalClaim("email", &email); err != nil || email != test.wantEmail {
+			t.Errorf("%s: expected email %q, got %q", test.name, test.wantEmail, email)
+		}
+		var encoded claims
+		if err := json.Unmarshal(data, &encoded); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(encoded["email"]); got != `"`+test.wantEmail+`"` {
+			t.Errorf("%s: expected encoded email %q, got %s", test.name, test.wantEmail, got)
+		}
+	}
+}
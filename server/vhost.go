@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// defaultSessionName is the session cookie name used unless configured.
+const defaultSessionName = "oidc-auth.session"
+
+// CookieConfig customizes the session cookie of a server.
+type CookieConfig struct {
+	// Name of the session cookie, default to "oidc-auth.session".
+	Name string `json:"name"`
+	// Domain of the session cookie, default to the host of the request.
+	Domain string `json:"domain"`
+	// Secure restricts the session cookie to HTTPS requests.
+	Secure bool `json:"secure"`
+}
+
+// VirtualHost is a tenant with its own configuration, serving requests
+// to any of the hosts.
+type VirtualHost struct {
+	// Hosts is a list of host patterns, a leading "*." matches any subdomain.
+	Hosts []string
+	// Config of the tenant, Store and AllowedOrigins default to the ones of
+	// the default server if not set. Sessions in a shared store are only
+	// accepted by the tenant of the issuer and client they're logged in with.
+	Config Config
+}
+
+// newVirtualHostRouter dispatches requests to the server of the first virtual host
+// matching the request host, the default server serves the others. The host is the
+// original one forwarded by trusted proxies.
+func newVirtualHostRouter(config Config, fallback http.Handler) (http.Handler, error) {
+	router := mux.NewRouter()
+	for i, vhost := range config.VirtualHosts {
+		if len(vhost.Hosts) == 0 {
+			return nil, errors.Errorf("server: virtual host %d: no hosts", i)
+		}
+		if len(vhost.Config.VirtualHosts) > 0 {
+			return nil, errors.Errorf("server: virtual host %q: nested virtual hosts are not supported", vhost.Hosts[0])
+		}
+
+		c := vhost.Config
+		if c.Store == nil {
+			c.Store = config.Store
+		}
+		if len(c.AllowedOrigins) == 0 {
+			c.AllowedOrigins = config.AllowedOrigins
+		}
+		// sessions of a user are counted across virtual hosts of the same issuer
+		c.SessionLimit = config.SessionLimit
+		s, err := NewServer(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "virtual host %q", vhost.Hosts[0])
+		}
+
+		hosts := vhost.Hosts
+		router.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			for _, pattern := range hosts {
+				if matchHost(pattern, r.Host) {
+					return true
+				}
+			}
+			return false
+		}).Handler(s)
+	}
+	router.PathPrefix("/").Handler(fallback)
+	return router, nil
+}
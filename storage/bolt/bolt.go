@@ -1,7 +1,10 @@
 package bolt
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"sort"
 	"time"
 
 	"github.com/gorilla/sessions"
@@ -13,8 +16,11 @@ import (
 type boltConn struct {
 	db *bolt.DB
 
-	bucketName    []byte
-	ttlBucketName []byte
+	bucketName      []byte
+	ttlBucketName   []byte
+	indexBucketName []byte
+	limitBucketName []byte
+	onceBucketName  []byte
 
 	maxAge time.Duration
 
@@ -67,3 +73,150 @@ func (c *boltConn) Delete(session *sessions.Session) error {
 		return tx.Bucket(c.bucketName).Delete([]byte(session.ID))
 	})
 }
+
+func (c *boltConn) List() (ids []string, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(c.bucketName).ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return
+}
+
+func (c *boltConn) AddToIndex(key string, session *sessions.Session) error {
+	expiry := time.Now().UTC().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	return c.db.Update(func(tx *bolt.Tx) error {
+		index, err := tx.Bucket(c.indexBucketName).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		return index.Put([]byte(session.ID), []byte(expiry.Format(time.RFC3339Nano)))
+	})
+}
+
+func (c *boltConn) LoadIndex(key string) (ids []string, err error) {
+	now := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	err = c.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(c.indexBucketName).Bucket([]byte(key))
+		if index == nil {
+			return nil
+		}
+		return index.ForEach(func(k, v []byte) error {
+			if bytes.Compare(v, now) > 0 {
+				ids = append(ids, string(k))
+			}
+			return nil
+		})
+	})
+	return
+}
+
+func (c *boltConn) RemoveFromIndex(key string, ids ...string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		indexes := tx.Bucket(c.indexBucketName)
+		index := indexes.Bucket([]byte(key))
+		if index == nil {
+			return nil
+		}
+		for _, id := range ids {
+			if err := index.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+
+		// drop the index once it's empty
+		if k, _ := index.Cursor().First(); k == nil {
+			return indexes.DeleteBucket([]byte(key))
+		}
+		return nil
+	})
+}
+
+func (c *boltConn) AddToLimitedIndex(key string, session *sessions.Session, max int, refuse bool) (evicted []string, added bool, err error) {
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		index, err := tx.Bucket(c.limitBucketName).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket(c.bucketName)
+
+		// sessions expired but not swept yet are not counted either
+		expired := make(map[string]bool)
+		if c.maxAge > 0 {
+			keys, _ := c.expired(tx, c.maxAge)
+			for _, k := range keys {
+				expired[string(k)] = true
+			}
+		}
+
+		// sessions deleted or expired are not counted, values are the time ids are recorded
+		type entry struct {
+			id       []byte
+			recorded []byte
+		}
+		var others []entry
+		var deleted [][]byte
+		err = index.ForEach(func(k, v []byte) error {
+			// keys and values are copied, since the index is modified below
+			k, v = append([]byte(nil), k...), append([]byte(nil), v...)
+			switch {
+			case bucket.Get(k) == nil || expired[string(k)]:
+				deleted = append(deleted, k)
+			case !bytes.Equal(k, []byte(session.ID)):
+				others = append(others, entry{id: k, recorded: v})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range deleted {
+			if err := index.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		if excess := len(others) - max + 1; excess > 0 {
+			if refuse {
+				return nil
+			}
+			sort.Slice(others, func(i, j int) bool { return bytes.Compare(others[i].recorded, others[j].recorded) < 0 })
+			for _, e := range others[:excess] {
+				if err := bucket.Delete(e.id); err != nil {
+					return err
+				}
+				if err := index.Delete(e.id); err != nil {
+					return err
+				}
+				evicted = append(evicted, string(e.id))
+			}
+		}
+
+		added = true
+		if index.Get([]byte(session.ID)) != nil {
+			return nil
+		}
+		recorded := make([]byte, 8)
+		binary.BigEndian.PutUint64(recorded, uint64(time.Now().UnixNano()))
+		return index.Put([]byte(session.ID), recorded)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return evicted, added, nil
+}
+
+func (c *boltConn) AddOnce(key string, ttl time.Duration) (added bool, err error) {
+	now := time.Now().UTC()
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		// values are the expiry of keys, which are swept along with sessions
+		bucket := tx.Bucket(c.onceBucketName)
+		if v := bucket.Get([]byte(key)); v != nil && bytes.Compare(v, []byte(now.Format(time.RFC3339Nano))) > 0 {
+			return nil
+		}
+		added = true
+		return bucket.Put([]byte(key), []byte(now.Add(ttl).Format(time.RFC3339Nano)))
+	})
+	return
+}
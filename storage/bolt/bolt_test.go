@@ -1,8 +1,11 @@
 package bolt_test
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/fezho/oidc-auth/storage/bolt"
 	"github.com/fezho/oidc-auth/storage/testutils"
@@ -28,4 +31,58 @@ func TestBoltStorage(t *testing.T) {
 	testutils.RunTestGet(t, s)
 	testutils.RunTestSave(t, s)
 	testutils.RunTestMaxAge(t, s)
+	testutils.RunTestIndex(t, s)
+	testutils.RunTestList(t, s)
+	testutils.RunTestLimitedIndex(t, s)
+	testutils.RunTestAddOnce(t, s)
+}
+
+func TestBoltLimitedIndexSkipsExpired(t *testing.T) {
+	path := "/tmp/data-limit.db"
+	sessionConfig := testutils.MockSessionConfig()
+	sessionConfig.MaxAge = 1
+	// sessions aren't swept in the test
+	cfg := &bolt.Config{
+		Path:          path,
+		BucketName:    "session",
+		SessionConfig: sessionConfig,
+	}
+	s, err := cfg.Open()
+	if err != nil {
+		t.Fatal("failed to open bolt storage", err)
+	}
+	defer func() {
+		_ = s.Close()       // nolint
+		_ = os.Remove(path) // nolint
+	}()
+
+	record := func() bool {
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, err := s.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		_, ok, err := s.IndexLimited(session, "limit:tyke", 1, true)
+		if err != nil {
+			t.Fatal("failed to record session", err)
+		}
+		if ok {
+			if err := session.Save(req, httptest.NewRecorder()); err != nil {
+				t.Fatal("failed to save session", err)
+			}
+		}
+		return ok
+	}
+
+	if !record() {
+		t.Fatal("expected session to be recorded")
+	}
+	if record() {
+		t.Fatal("expected session to be refused")
+	}
+	// the recorded session expires but isn't swept
+	time.Sleep(1100 * time.Millisecond)
+	if !record() {
+		t.Fatal("expected expired session not to be counted")
+	}
 }
@@ -35,6 +35,9 @@ func (c *Config) Open() (*storage.Storage, error) {
 
 	bucket := []byte(c.BucketName)
 	ttlBucket := []byte(c.BucketName + "-ttl")
+	indexBucket := []byte(c.BucketName + "-index")
+	limitBucket := []byte(c.BucketName + "-limit")
+	onceBucket := []byte(c.BucketName + "-once")
 
 	err = db.Update(func(tx *bolt.Tx) error {
 		// create session bucket
@@ -49,6 +52,24 @@ func (c *Config) Open() (*storage.Storage, error) {
 			return fmt.Errorf("create bucket %s error: %v", string(ttlBucket), err)
 		}
 
+		// create an index bucket which contains a nested bucket per index key
+		_, err = tx.CreateBucketIfNotExists(indexBucket)
+		if err != nil {
+			return fmt.Errorf("create bucket %s error: %v", string(indexBucket), err)
+		}
+
+		// create a limit bucket which contains a nested bucket per limited index key
+		_, err = tx.CreateBucketIfNotExists(limitBucket)
+		if err != nil {
+			return fmt.Errorf("create bucket %s error: %v", string(limitBucket), err)
+		}
+
+		// create a once bucket to record keys used once until they expire
+		_, err = tx.CreateBucketIfNotExists(onceBucket)
+		if err != nil {
+			return fmt.Errorf("create bucket %s error: %v", string(onceBucket), err)
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -57,11 +78,14 @@ func (c *Config) Open() (*storage.Storage, error) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	conn := &boltConn{
-		db:            db,
-		bucketName:    bucket,
-		ttlBucketName: ttlBucket,
-		cancel:        cancel,
-		maxAge:        time.Second * time.Duration(c.MaxAge),
+		db:              db,
+		bucketName:      bucket,
+		ttlBucketName:   ttlBucket,
+		indexBucketName: indexBucket,
+		limitBucketName: limitBucket,
+		onceBucketName:  onceBucket,
+		cancel:          cancel,
+		maxAge:          time.Second * time.Duration(c.MaxAge),
 	}
 
 	if c.SweepFrequency > 0 {
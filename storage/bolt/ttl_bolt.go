@@ -19,6 +19,15 @@ func (c *boltConn) startSweeping(ctx context.Context, frequency time.Duration) {
 				if err := c.sweep(c.maxAge); err != nil {
 					log.Errorf("bolt db: sweep expired session task failed: %v", err)
 				}
+				if err := c.sweepIndexes(); err != nil {
+					log.Errorf("bolt db: sweep expired index task failed: %v", err)
+				}
+				if err := c.sweepLimits(); err != nil {
+					log.Errorf("bolt db: sweep expired limit task failed: %v", err)
+				}
+				if err := c.sweepOnce(); err != nil {
+					log.Errorf("bolt db: sweep expired once task failed: %v", err)
+				}
 			}
 		}
 	}()
@@ -51,14 +60,131 @@ func (c *boltConn) sweep(maxAge time.Duration) error {
 
 func (c *boltConn) getExpired(maxAge time.Duration) (keys, ttlKeys [][]byte, err error) {
 	err = c.db.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket(c.ttlBucketName).Cursor()
+		keys, ttlKeys = c.expired(tx, maxAge)
+		return nil
+	})
+	return
+}
+
+// expired returns the ids of sessions saved maxAge ago and their ttl keys in tx,
+// which are deleted by the next sweep.
+func (c *boltConn) expired(tx *bolt.Tx, maxAge time.Duration) (keys, ttlKeys [][]byte) {
+	cur := tx.Bucket(c.ttlBucketName).Cursor()
+
+	max := []byte(time.Now().UTC().Add(-maxAge).Format(time.RFC3339Nano))
+	for k, v := cur.First(); k != nil && bytes.Compare(k, max) <= 0; k, v = cur.Next() {
+		keys = append(keys, v)
+		ttlKeys = append(ttlKeys, k)
+	}
+	return
+}
+
+// sweepIndexes removes expired session ids from all indexes.
+func (c *boltConn) sweepIndexes() error {
+	now := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	return c.db.Update(func(tx *bolt.Tx) error {
+		indexes := tx.Bucket(c.indexBucketName)
 
-		max := []byte(time.Now().UTC().Add(-maxAge).Format(time.RFC3339Nano))
-		for k, v := c.First(); k != nil && bytes.Compare(k, max) <= 0; k, v = c.Next() {
-			keys = append(keys, v)
-			ttlKeys = append(ttlKeys, k)
+		var emptyKeys [][]byte
+		err := indexes.ForEach(func(key, _ []byte) error {
+			index := indexes.Bucket(key)
+			if index == nil {
+				return nil
+			}
+
+			cur := index.Cursor()
+			for k, v := cur.First(); k != nil; {
+				if bytes.Compare(v, now) <= 0 {
+					if err := cur.Delete(); err != nil {
+						return err
+					}
+					// cursor moves to the next item after deletion
+					k, v = cur.Seek(k)
+					continue
+				}
+				k, v = cur.Next()
+			}
+
+			if k, _ := index.Cursor().First(); k == nil {
+				emptyKeys = append(emptyKeys, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range emptyKeys {
+			if err := indexes.DeleteBucket(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// sweepLimits removes ids of deleted sessions from all limited indexes.
+func (c *boltConn) sweepLimits() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(c.bucketName)
+		limits := tx.Bucket(c.limitBucketName)
+
+		var emptyKeys [][]byte
+		err := limits.ForEach(func(key, _ []byte) error {
+			index := limits.Bucket(key)
+			if index == nil {
+				return nil
+			}
+
+			var deleted [][]byte
+			if err := index.ForEach(func(k, _ []byte) error {
+				if bucket.Get(k) == nil {
+					deleted = append(deleted, append([]byte(nil), k...))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, k := range deleted {
+				if err := index.Delete(k); err != nil {
+					return err
+				}
+			}
+
+			if k, _ := index.Cursor().First(); k == nil {
+				emptyKeys = append(emptyKeys, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range emptyKeys {
+			if err := limits.DeleteBucket(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// sweepOnce removes expired keys recorded once.
+func (c *boltConn) sweepOnce() error {
+	now := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	return c.db.Update(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(c.onceBucketName).Cursor()
+		for k, v := cur.First(); k != nil; {
+			if bytes.Compare(v, now) <= 0 {
+				if err := cur.Delete(); err != nil {
+					return err
+				}
+				// cursor moves to the next item after deletion
+				k, v = cur.Seek(k)
+				continue
+			}
+			k, v = cur.Next()
 		}
 		return nil
 	})
-	return
 }
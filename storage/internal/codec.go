@@ -12,6 +12,7 @@ const defaultHashKey = "Don'tChangeTheKeyValueAnyMoreAfterRunningOnce"
 
 func init() {
 	gob.Register(map[string]interface{}{})
+	gob.Register(map[string]string{})
 }
 
 // Encode encodes session values to bytes.
@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -21,6 +22,9 @@ func init() {
 func (c *Config) Open() (*storage.Storage, error) {
 	conn := &memoryConn{
 		sessions: make(map[string]valueType),
+		indexes:  make(map[string]map[string]int64),
+		limits:   make(map[string]map[string]int64),
+		once:     make(map[string]int64),
 	}
 	return storage.New(conn, c.SessionConfig), nil
 }
@@ -36,6 +40,12 @@ type memoryConn struct {
 	mu sync.RWMutex
 
 	sessions map[string]valueType
+	// indexes maps index key to session ids and their ttl
+	indexes map[string]map[string]int64
+	// limits maps limited index key to session ids and the time they're recorded
+	limits map[string]map[string]int64
+	// once maps keys recorded once to their ttl
+	once map[string]int64
 }
 
 type valueType struct {
@@ -81,6 +91,117 @@ func (m *memoryConn) Delete(session *sessions.Session) error {
 	return nil
 }
 
+func (m *memoryConn) List() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := make([]string, 0, len(m.sessions))
+	for id, value := range m.sessions {
+		if !isExpired(value.ttl) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (m *memoryConn) AddToIndex(key string, session *sessions.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	index, ok := m.indexes[key]
+	if !ok {
+		index = make(map[string]int64)
+		m.indexes[key] = index
+	}
+	index[session.ID] = time.Now().UTC().Unix() + int64(session.Options.MaxAge)
+	return nil
+}
+
+func (m *memoryConn) LoadIndex(key string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []string
+	for id, ttl := range m.indexes[key] {
+		if !isExpired(ttl) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (m *memoryConn) RemoveFromIndex(key string, ids ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	index := m.indexes[key]
+	for _, id := range ids {
+		delete(index, id)
+	}
+	if len(index) == 0 {
+		delete(m.indexes, key)
+	}
+	return nil
+}
+
+func (m *memoryConn) AddToLimitedIndex(key string, session *sessions.Session, max int, refuse bool) ([]string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	index, ok := m.limits[key]
+	if !ok {
+		index = make(map[string]int64)
+		m.limits[key] = index
+	}
+
+	// sessions deleted or expired are not counted
+	var others []string
+	for id := range index {
+		if value, ok := m.sessions[id]; !ok || isExpired(value.ttl) {
+			delete(index, id)
+		} else if id != session.ID {
+			others = append(others, id)
+		}
+	}
+
+	var evicted []string
+	if excess := len(others) - max + 1; excess > 0 {
+		if refuse {
+			if len(index) == 0 {
+				delete(m.limits, key)
+			}
+			return nil, false, nil
+		}
+		sort.Slice(others, func(i, j int) bool { return index[others[i]] < index[others[j]] })
+		for _, id := range others[:excess] {
+			delete(m.sessions, id)
+			delete(index, id)
+			evicted = append(evicted, id)
+		}
+	}
+
+	if _, ok := index[session.ID]; !ok {
+		index[session.ID] = time.Now().UnixNano()
+	}
+	return evicted, true, nil
+}
+
+func (m *memoryConn) AddOnce(key string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, expiry := range m.once {
+		if isExpired(expiry) {
+			delete(m.once, k)
+		}
+	}
+	if _, ok := m.once[key]; ok {
+		return false, nil
+	}
+	m.once[key] = time.Now().UTC().Add(ttl).Unix()
+	return true, nil
+}
+
 func (m *memoryConn) Close() error {
 	return nil
 }
@@ -19,4 +19,8 @@ func TestMemoryStorage(t *testing.T) {
 	testutils.RunTestGet(t, s)
 	testutils.RunTestSave(t, s)
 	testutils.RunTestMaxAge(t, s)
+	testutils.RunTestIndex(t, s)
+	testutils.RunTestList(t, s)
+	testutils.RunTestLimitedIndex(t, s)
+	testutils.RunTestAddOnce(t, s)
 }
@@ -8,7 +8,9 @@ import (
 	"github.com/fezho/oidc-auth/storage"
 )
 
-// Redis config for connecting to redis server.
+// Redis config for connecting to redis server. Only a single redis server is
+// supported rather than Redis Cluster, since sessions of a user are limited by a
+// script accessing session keys which may be in other hash slots.
 type Config struct {
 	storage.SessionConfig `json:",inline"`
 
@@ -1,6 +1,9 @@
 package redis
 
 import (
+	"strings"
+	"time"
+
 	"github.com/gomodule/redigo/redis"
 	"github.com/gorilla/sessions"
 
@@ -32,6 +35,18 @@ func (c *redisConn) getKey(sessionID string) string {
 	return c.keyPrefix + sessionID
 }
 
+func (c *redisConn) getIndexKey(key string) string {
+	return c.keyPrefix + "index:" + key
+}
+
+func (c *redisConn) getLimitKey(key string) string {
+	return c.keyPrefix + "limit:" + key
+}
+
+func (c *redisConn) getOnceKey(key string) string {
+	return c.keyPrefix + "once:" + key
+}
+
 func (c *redisConn) Save(session *sessions.Session) error {
 	data, err := internal.Encode(session)
 	if err != nil {
@@ -73,3 +88,148 @@ func (c *redisConn) Delete(session *sessions.Session) error {
 	_, err := conn.Do("DEL", c.getKey(session.ID))
 	return err
 }
+
+func (c *redisConn) List() ([]string, error) {
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	// keys are scanned incrementally, so that redis isn't blocked like KEYS
+	pattern := globEscaper.Replace(c.keyPrefix) + "*"
+	indexPrefix, limitPrefix, oncePrefix := c.getIndexKey(""), c.getLimitKey(""), c.getOnceKey("")
+	var ids []string
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		if cursor, err = redis.Int(values[0], nil); err != nil {
+			return nil, err
+		}
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if strings.HasPrefix(key, indexPrefix) || strings.HasPrefix(key, limitPrefix) || strings.HasPrefix(key, oncePrefix) {
+				continue
+			}
+			ids = append(ids, strings.TrimPrefix(key, c.keyPrefix))
+		}
+		if cursor == 0 {
+			return ids, nil
+		}
+	}
+}
+
+// globEscaper escapes the special characters of redis glob-style patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (c *redisConn) AddToIndex(key string, session *sessions.Session) error {
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	// the index is kept as long as its latest session
+	indexKey := c.getIndexKey(key)
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	if err := conn.Send("SADD", indexKey, session.ID); err != nil {
+		return err
+	}
+	if err := conn.Send("EXPIRE", indexKey, session.Options.MaxAge); err != nil {
+		return err
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (c *redisConn) LoadIndex(key string) ([]string, error) {
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("SMEMBERS", c.getIndexKey(key)))
+}
+
+func (c *redisConn) RemoveFromIndex(key string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SREM", redis.Args{}.Add(c.getIndexKey(key)).AddFlat(ids)...)
+	return err
+}
+
+// limitScript counts, evicts and records sessions of a limited index atomically. The
+// index is a sorted set of session ids scored by the time they're recorded, ids of
+// deleted sessions are removed first. It returns 0 if the index is full and eviction
+// is refused, otherwise 1 followed by the evicted ids.
+//
+// Session keys are built from ARGV rather than declared in KEYS, which a single
+// redis server allows, while Redis Cluster can't route them, so it's not supported.
+//
+//	KEYS[1]: limited index key
+//	ARGV: session key prefix, session id, time in milliseconds, max, refuse, ttl
+var limitScript = redis.NewScript(1, `
+local others = {}
+for _, id in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	if redis.call('EXISTS', ARGV[1] .. id) == 0 then
+		redis.call('ZREM', KEYS[1], id)
+	elseif id ~= ARGV[2] then
+		table.insert(others, id)
+	end
+end
+
+local result = {1}
+local excess = #others - tonumber(ARGV[4]) + 1
+if excess > 0 then
+	if ARGV[5] == '1' then
+		return {0}
+	end
+	for i = 1, excess do
+		redis.call('DEL', ARGV[1] .. others[i])
+		redis.call('ZREM', KEYS[1], others[i])
+		table.insert(result, others[i])
+	end
+end
+
+redis.call('ZADD', KEYS[1], 'NX', ARGV[3], ARGV[2])
+redis.call('EXPIRE', KEYS[1], ARGV[6])
+return result
+`)
+
+func (c *redisConn) AddToLimitedIndex(key string, session *sessions.Session, max int, refuse bool) ([]string, bool, error) {
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	// the index is kept as long as its latest session
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	values, err := redis.Values(limitScript.Do(conn, c.getLimitKey(key),
+		c.keyPrefix, session.ID, now, max, refuse, session.Options.MaxAge))
+	if err != nil {
+		return nil, false, err
+	}
+	if added, err := redis.Int(values[0], nil); err != nil || added == 0 {
+		return nil, false, err
+	}
+	evicted, err := redis.Strings(values[1:], nil)
+	if err != nil {
+		return nil, false, err
+	}
+	return evicted, true, nil
+}
+
+func (c *redisConn) AddOnce(key string, ttl time.Duration) (bool, error) {
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	// nil is replied if the key exists
+	reply, err := conn.Do("SET", c.getOnceKey(key), 1, "NX", "PX", int64(ttl/time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
@@ -24,4 +24,8 @@ func TestRedisStorage(t *testing.T) {
 	testutils.RunTestGet(t, s)
 	testutils.RunTestSave(t, s)
 	testutils.RunTestMaxAge(t, s)
+	testutils.RunTestIndex(t, s)
+	testutils.RunTestList(t, s)
+	testutils.RunTestLimitedIndex(t, s)
+	testutils.RunTestAddOnce(t, s)
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
@@ -24,16 +25,6 @@ type Storage struct {
 	options *sessions.Options
 }
 
-// TODO: support one place login? or just delete the old one when saving session
-/*
-type IStroage interface {
-	sessions.Store
-
-	SetUserToken(user, token string) error
-	IsLatestUserToken(user, token string) (bool, error)
-}
-*/
-
 // Conn is the interface for underlying persistent database
 type Conn interface {
 	// Load reads the session from the database.
@@ -43,6 +34,24 @@ type Conn interface {
 	Save(session *sessions.Session) error
 	// Delete removes keys from the database if MaxAge<0
 	Delete(session *sessions.Session) error
+	// List returns the ids of all the sessions in the database.
+	List() ([]string, error)
+	// AddToIndex records the session id in the index of key,
+	// the record expires along with the session.
+	AddToIndex(key string, session *sessions.Session) error
+	// LoadIndex returns the session ids recorded in the index of key,
+	// sessions of the ids may have been deleted.
+	LoadIndex(key string) ([]string, error)
+	// RemoveFromIndex removes the session ids from the index of key.
+	RemoveFromIndex(key string, ids ...string) error
+	// AddToLimitedIndex records the session id in the limited index of key, which keeps
+	// at most max sessions. Existing sessions are counted, evicted and the id is recorded
+	// atomically. The earliest recorded sessions are deleted to make room and their ids
+	// are returned, unless refuse is true, then nothing changes and false is returned.
+	AddToLimitedIndex(key string, session *sessions.Session, max int, refuse bool) ([]string, bool, error)
+	// AddOnce records the key until ttl passes, it returns false if the key
+	// is recorded already.
+	AddOnce(key string, ttl time.Duration) (bool, error)
 	// Close closes the database.
 	Close() error
 }
@@ -134,11 +143,8 @@ func (s *Storage) Save(r *http.Request, w http.ResponseWriter, session *sessions
 		return nil
 	}
 
-	// encode id to use alphanumeric characters only for internal db usage.
 	if session.ID == "" {
-		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(
-			securecookie.GenerateRandomKey(32)),
-			"=")
+		session.ID = newSessionID()
 	}
 
 	if err := s.conn.Save(session); err != nil {
@@ -154,6 +160,11 @@ func (s *Storage) Save(r *http.Request, w http.ResponseWriter, session *sessions
 	return nil
 }
 
+// newSessionID encodes id to use alphanumeric characters only for internal db usage.
+func newSessionID() string {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+}
+
 // MaxAge sets the maximum age for the store and the underlying cookie
 // implementation. Individual sessions can be deleted by setting options.MaxAge
 // = -1 for that session.
@@ -168,6 +179,105 @@ func (s *Storage) MaxAge(age int) {
 	}
 }
 
+// Index records the saved session in the index of each key,
+// so that it can be found by any of the keys later.
+func (s *Storage) Index(session *sessions.Session, keys ...string) error {
+	for _, key := range keys {
+		if err := s.conn.AddToIndex(key, session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IndexLimited records the session in the limited index of key, which keeps at most
+// max sessions, the id of a new session is assigned before it's saved. The earliest
+// recorded sessions are deleted to make room and their ids are returned, unless refuse
+// is true, then the session is not recorded and false is returned.
+func (s *Storage) IndexLimited(session *sessions.Session, key string, max int, refuse bool) ([]string, bool, error) {
+	if session.ID == "" {
+		session.ID = newSessionID()
+	}
+	return s.conn.AddToLimitedIndex(key, session, max, refuse)
+}
+
+// AddOnce records the key until ttl passes, it returns false if the key is
+// recorded already, so that the same token can't be used twice.
+func (s *Storage) AddOnce(key string, ttl time.Duration) (bool, error) {
+	return s.conn.AddOnce(key, ttl)
+}
+
+// DeleteIndexed deletes all the sessions in the index of key, and the index itself.
+func (s *Storage) DeleteIndexed(key string) error {
+	ids, err := s.conn.LoadIndex(key)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		session := sessions.NewSession(s, "")
+		session.ID = id
+		if err := s.conn.Delete(session); err != nil {
+			return err
+		}
+	}
+	return s.conn.RemoveFromIndex(key, ids...)
+}
+
+// List returns the ids of all the sessions.
+func (s *Storage) List() ([]string, error) {
+	return s.conn.List()
+}
+
+// ListIndexed returns the ids of existing sessions in the index of key,
+// ids of the deleted sessions are removed from the index.
+func (s *Storage) ListIndexed(key string) ([]string, error) {
+	ids, err := s.conn.LoadIndex(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var existing, deleted []string
+	for _, id := range ids {
+		_, ok, err := s.Lookup(id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			existing = append(existing, id)
+		} else {
+			deleted = append(deleted, id)
+		}
+	}
+	if len(deleted) > 0 {
+		if err := s.conn.RemoveFromIndex(key, deleted...); err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
+
+// Lookup loads the session of id, it returns false if the session doesn't exist.
+func (s *Storage) Lookup(id string) (*sessions.Session, bool, error) {
+	session := sessions.NewSession(s, "")
+	session.ID = id
+	opts := *s.options
+	session.Options = &opts
+
+	ok, err := s.conn.Load(session)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return session, true, nil
+}
+
+// Remove deletes the session of id.
+func (s *Storage) Remove(id string) error {
+	session := sessions.NewSession(s, "")
+	session.ID = id
+	return s.conn.Delete(session)
+}
+
 func (s *Storage) Close() error {
 	return s.conn.Close()
 }
@@ -207,6 +207,224 @@ func RunTestMaxAge(t *testing.T, s *storage.Storage) {
 	})
 }
 
+func RunTestIndex(t *testing.T, s *storage.Storage) {
+	t.Run("Index", func(t *testing.T) {
+		// round 1 save two sessions and index them by same key
+		var cookies []string
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+			session, err := s.New(req, "hello")
+			if err != nil {
+				t.Fatal("failed to create session", err)
+			}
+			rsp := httptest.NewRecorder()
+			if err := session.Save(req, rsp); err != nil {
+				t.Fatal("failed to save session", err)
+			}
+			if err := s.Index(session, "user:tom", "sid:"+session.ID); err != nil {
+				t.Fatal("failed to index session", err)
+			}
+			cookies = append(cookies, rsp.Header().Get("Set-Cookie"))
+		}
+
+		// round 2 delete sessions by the index key
+		if err := s.DeleteIndexed("user:tom"); err != nil {
+			t.Fatal("failed to delete indexed sessions", err)
+		}
+
+		// round 3 check sessions are deleted
+		for _, cookie := range cookies {
+			req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+			req.Header.Add("Cookie", cookie)
+			session, err := s.New(req, "hello")
+			if err != nil {
+				t.Fatal("failed to get session, ", err)
+			}
+			if !session.IsNew {
+				t.Fatalf("expected to get new session after being deleted")
+			}
+		}
+
+		// round 4 delete by an unknown key
+		if err := s.DeleteIndexed("user:jerry"); err != nil {
+			t.Fatal("failed to delete sessions of unknown index", err)
+		}
+	})
+}
+
+func RunTestList(t *testing.T, s *storage.Storage) {
+	t.Run("List", func(t *testing.T) {
+		// round 1 save a session and index it
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, err := s.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		session.Values["user_name"] = "spike"
+		if err := session.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		if err := s.Index(session, "user:spike"); err != nil {
+			t.Fatal("failed to index session", err)
+		}
+
+		// round 2 find the session in all sessions and the index
+		ids, err := s.List()
+		if err != nil {
+			t.Fatal("failed to list sessions", err)
+		}
+		if !contains(ids, session.ID) {
+			t.Fatalf("expected session %s in %v", session.ID, ids)
+		}
+		ids, err = s.ListIndexed("user:spike")
+		if err != nil {
+			t.Fatal("failed to list indexed sessions", err)
+		}
+		if len(ids) != 1 || ids[0] != session.ID {
+			t.Fatalf("expected indexed sessions to be [%s], got %v", session.ID, ids)
+		}
+
+		// round 3 look up the session by id
+		found, ok, err := s.Lookup(session.ID)
+		if err != nil || !ok {
+			t.Fatalf("failed to look up session, %v", err)
+		}
+		if found.Values["user_name"] != "spike" {
+			t.Fatalf("expected user_name to be spike, got %v", found.Values["user_name"])
+		}
+
+		// round 4 removed session is neither listed nor indexed
+		if err := s.Remove(session.ID); err != nil {
+			t.Fatal("failed to remove session", err)
+		}
+		if _, ok, err := s.Lookup(session.ID); err != nil || ok {
+			t.Fatalf("expected session to be removed, got %v, %v", ok, err)
+		}
+		ids, err = s.List()
+		if err != nil {
+			t.Fatal("failed to list sessions", err)
+		}
+		if contains(ids, session.ID) {
+			t.Fatalf("expected session %s to be removed from %v", session.ID, ids)
+		}
+		ids, err = s.ListIndexed("user:spike")
+		if err != nil {
+			t.Fatal("failed to list indexed sessions", err)
+		}
+		if len(ids) != 0 {
+			t.Fatalf("expected no indexed sessions, got %v", ids)
+		}
+	})
+}
+
+func RunTestLimitedIndex(t *testing.T, s *storage.Storage) {
+	t.Run("LimitedIndex", func(t *testing.T) {
+		// round 1 record two sessions within the limit, ids are assigned before saving
+		var ids []string
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+			session, err := s.New(req, "hello")
+			if err != nil {
+				t.Fatal("failed to create session", err)
+			}
+			evicted, ok, err := s.IndexLimited(session, "limit:tyke", 2, false)
+			if err != nil || !ok || len(evicted) != 0 {
+				t.Fatalf("expected session to be recorded, got %v, %v, %v", evicted, ok, err)
+			}
+			if session.ID == "" {
+				t.Fatal("expected session id to be assigned")
+			}
+			if err := session.Save(req, httptest.NewRecorder()); err != nil {
+				t.Fatal("failed to save session", err)
+			}
+			ids = append(ids, session.ID)
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// round 2 recording an existing session again doesn't evict others
+		existing, _, err := s.Lookup(ids[0])
+		if err != nil {
+			t.Fatal("failed to look up session", err)
+		}
+		evicted, ok, err := s.IndexLimited(existing, "limit:tyke", 2, true)
+		if err != nil || !ok || len(evicted) != 0 {
+			t.Fatalf("expected existing session to be recorded, got %v, %v, %v", evicted, ok, err)
+		}
+
+		// round 3 a new session is refused
+		req, _ := http.NewRequest("GET", "http://www.example.com", nil)
+		session, err := s.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		evicted, ok, err = s.IndexLimited(session, "limit:tyke", 2, true)
+		if err != nil || ok || len(evicted) != 0 {
+			t.Fatalf("expected session to be refused, got %v, %v, %v", evicted, ok, err)
+		}
+
+		// round 4 the oldest session is evicted for a new session
+		evicted, ok, err = s.IndexLimited(session, "limit:tyke", 2, false)
+		if err != nil || !ok {
+			t.Fatalf("expected session to be recorded, got %v, %v", ok, err)
+		}
+		if len(evicted) != 1 || evicted[0] != ids[0] {
+			t.Fatalf("expected evicted sessions to be [%s], got %v", ids[0], evicted)
+		}
+		if _, ok, err := s.Lookup(ids[0]); err != nil || ok {
+			t.Fatalf("expected evicted session to be deleted, got %v, %v", ok, err)
+		}
+		if err := session.Save(req, httptest.NewRecorder()); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+
+		// round 5 removed sessions are not counted
+		if err := s.Remove(ids[1]); err != nil {
+			t.Fatal("failed to remove session", err)
+		}
+		req, _ = http.NewRequest("GET", "http://www.example.com", nil)
+		another, err := s.New(req, "hello")
+		if err != nil {
+			t.Fatal("failed to create session", err)
+		}
+		evicted, ok, err = s.IndexLimited(another, "limit:tyke", 2, true)
+		if err != nil || !ok || len(evicted) != 0 {
+			t.Fatalf("expected session to be recorded, got %v, %v, %v", evicted, ok, err)
+		}
+	})
+}
+
+func RunTestAddOnce(t *testing.T, s *storage.Storage) {
+	t.Run("AddOnce", func(t *testing.T) {
+		// round 1 a key is added only once
+		if ok, err := s.AddOnce("jti:tyke", time.Second); err != nil || !ok {
+			t.Fatalf("expected key to be added, got %v, %v", ok, err)
+		}
+		if ok, err := s.AddOnce("jti:tyke", time.Second); err != nil || ok {
+			t.Fatalf("expected key to be added once, got %v, %v", ok, err)
+		}
+
+		// round 2 other keys are not affected
+		if ok, err := s.AddOnce("jti:other", time.Second); err != nil || !ok {
+			t.Fatalf("expected another key to be added, got %v, %v", ok, err)
+		}
+
+		// round 3 the key can be added again after it expires
+		time.Sleep(2 * time.Second)
+		if ok, err := s.AddOnce("jti:tyke", time.Second); err != nil || !ok {
+			t.Fatalf("expected expired key to be added, got %v, %v", ok, err)
+		}
+	})
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
 func MockSessionConfig() storage.SessionConfig {
 	key1 := string(securecookie.GenerateRandomKey(32))
 	key2 := string(securecookie.GenerateRandomKey(32))